@@ -1,6 +1,8 @@
 package main
 
 import (
+	"os"
+
 	"github.com/duanckham/nginless/internal/app/config"
 	"github.com/duanckham/nginless/internal/app/nginless"
 	"go.uber.org/zap"
@@ -9,6 +11,16 @@ import (
 )
 
 func main() {
+	// Subcommands which only need the router config.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(nginless.Check(os.Args[2:]))
+		case "route":
+			os.Exit(nginless.Route(os.Args[2:]))
+		}
+	}
+
 	c := config.ReadConfig()
 
 	// Log rotate.
@@ -5,10 +5,12 @@ go 1.16
 require (
 	github.com/d5/tengo/v2 v2.7.0
 	github.com/duanckham/go-pcre v0.0.0-20191122205722-613496bb8aff
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/soheilhy/cmux v0.1.5
 	github.com/spf13/viper v1.8.1
 	github.com/valyala/bytebufferpool v1.0.0
 	go.uber.org/zap v1.17.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
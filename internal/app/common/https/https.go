@@ -2,7 +2,10 @@ package https
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net"
+	"sync/atomic"
 )
 
 // Listener ...
@@ -12,16 +15,22 @@ type Listener interface {
 	Addr() net.Addr
 	Bind(listener net.Listener)
 	LoadPairs(pairs [][2]string)
+	ReloadPairs(pairs [][2]string) error
 }
 
 type listenerImpl struct {
-	config   *tls.Config
-	listener net.Listener
+	config       *tls.Config
+	listener     net.Listener
+	certificates atomic.Value
 }
 
 // New ...
 func New() Listener {
-	return &listenerImpl{}
+	l := &listenerImpl{}
+	l.config = &tls.Config{GetCertificate: l.getCertificate}
+	l.certificates.Store([]tls.Certificate{})
+
+	return l
 }
 
 // Accept ...
@@ -55,19 +64,50 @@ func (l *listenerImpl) Bind(listener net.Listener) {
 
 // LoadPairs ...
 func (l *listenerImpl) LoadPairs(pairs [][2]string) {
-	var err error
+	if err := l.ReloadPairs(pairs); err != nil {
+		panic(err.Error())
+	}
+}
 
-	l.config = &tls.Config{}
-	l.config.Certificates = make([]tls.Certificate, len(pairs))
+// ReloadPairs replaces the certificates served by the listener, the current
+// ones are kept when any pair fails to load. Connections already established
+// keep their certificate.
+func (l *listenerImpl) ReloadPairs(pairs [][2]string) error {
+	certificates := make([]tls.Certificate, len(pairs))
 
 	for i, pair := range pairs {
-		if len(pair) < 2 {
-			panic("certificate pair missing")
+		certificate, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return fmt.Errorf("load certificate pair %s, %s failed: %s", pair[0], pair[1], err)
 		}
 
-		l.config.Certificates[i], err = tls.LoadX509KeyPair(pair[0], pair[1])
+		// Parsed once here rather than on every handshake.
+		certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
 		if err != nil {
-			panic("load certificate pairs failed")
+			return fmt.Errorf("parse certificate %s failed: %s", pair[0], err)
 		}
+
+		certificates[i] = certificate
 	}
+
+	l.certificates.Store(certificates)
+
+	return nil
+}
+
+// getCertificate picks the first certificate the client supports, usually by
+// SNI, the first one is the default as tls.Config.Certificates does.
+func (l *listenerImpl) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificates := l.certificates.Load().([]tls.Certificate)
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificate")
+	}
+
+	for i := range certificates {
+		if hello.SupportsCertificate(&certificates[i]) == nil {
+			return &certificates[i], nil
+		}
+	}
+
+	return &certificates[0], nil
 }
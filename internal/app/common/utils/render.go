@@ -13,48 +13,72 @@ const (
 	R = 125
 )
 
-// Render ...
+// Render replaces `{{name}}` or `{{.name}}` placeholders in template with
+// values from parameters, unknown names are rendered as empty strings.
 func Render(template string, parameters map[string]string) string {
-	s := ""
-	t := []string{}
-	i := 0
-	l := 0
-	r := 0
-
-	for j, c := range template {
-		switch c {
-		case L:
-			l++
-
-		case R:
-			r++
-
-			if l == 2 && r == 2 {
-				if v, ok := parameters[template[i:j-1]]; ok {
-					t = append(t, v)
-				}
-
-				l = 0
-				r = 0
-				i = j + 1
-			}
-
-		case D:
-			if l == 2 {
-				t = append(t, template[i:j-2])
-				i = j + 1
-			}
-
-		default:
-			if l == 1 {
-				l = 0
-			}
-
-			if j == len(template)-1 {
-				s = strings.Join(t, "") + template[i:]
-			}
+	left := string([]byte{L, L})
+	right := string([]byte{R, R})
+
+	if !strings.Contains(template, left) {
+		return template
+	}
+
+	var b strings.Builder
+
+	for {
+		i := strings.Index(template, left)
+		if i < 0 {
+			break
+		}
+
+		j := strings.Index(template[i+2:], right)
+		if j < 0 {
+			break
+		}
+
+		name := strings.TrimSpace(template[i+2 : i+2+j])
+		if len(name) > 0 && name[0] == D {
+			name = name[1:]
+		}
+
+		b.WriteString(template[:i])
+		b.WriteString(parameters[name])
+
+		template = template[i+2+j+2:]
+	}
+
+	b.WriteString(template)
+
+	return b.String()
+}
+
+// Names returns the names of the placeholders in template, in order.
+func Names(template string) []string {
+	left := string([]byte{L, L})
+	right := string([]byte{R, R})
+
+	names := []string{}
+
+	for {
+		i := strings.Index(template, left)
+		if i < 0 {
+			break
 		}
+
+		j := strings.Index(template[i+2:], right)
+		if j < 0 {
+			break
+		}
+
+		name := strings.TrimSpace(template[i+2 : i+2+j])
+		if len(name) > 0 && name[0] == D {
+			name = name[1:]
+		}
+
+		names = append(names, name)
+
+		template = template[i+2+j+2:]
 	}
 
-	return s
+	return names
 }
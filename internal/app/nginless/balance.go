@@ -0,0 +1,286 @@
+package nginless
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Strategies of balancing.
+const (
+	strategyRandom     = "random"
+	strategyRoundRobin = "round_robin"
+	strategyLeastConn  = "least_conn"
+	strategyHash       = "hash"
+)
+
+var strategies = map[string]bool{
+	strategyRandom:     true,
+	strategyRoundRobin: true,
+	strategyLeastConn:  true,
+	strategyHash:       true,
+}
+
+// hashReplicas is the number of points an upstream of weight 1 has on the
+// ring, more points spread the keys more evenly.
+const hashReplicas = 160
+
+// maxBalanceStates bounds the round robins and rings kept, upstreams can be
+// rendered from the request.
+const maxBalanceStates = 1024
+
+var (
+	// outstanding counts the requests in flight by upstream, an upstream
+	// without any is dropped.
+	outstanding = struct {
+		sync.Mutex
+		counts map[string]int64
+	}{counts: map[string]int64{}}
+
+	// roundRobins keeps the state of round robin by upstreams and weights.
+	roundRobins = newLRU(maxBalanceStates, nil)
+
+	// rings caches the hash rings by upstreams and weights.
+	rings = newLRU(maxBalanceStates, nil)
+)
+
+// balanceOrder returns the indexes of the upstreams in the order balancing
+// tries them, the first one is picked by the strategy.
+func balanceOrder(d *D, upstreams []string, options StepOptions) []int {
+	weights := options.Ints("weights")
+	if len(weights) != len(upstreams) {
+		weights = make([]int64, len(upstreams))
+
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+
+	switch options.String("strategy", strategyRandom) {
+	case strategyRoundRobin:
+		first := roundRobinOf(upstreams, weights).next()
+		order := []int{first}
+
+		for i := 1; i < len(upstreams); i++ {
+			order = append(order, (first+i)%len(upstreams))
+		}
+
+		return order
+
+	case strategyLeastConn:
+		order := make([]int, len(upstreams))
+		load := make([]float64, len(upstreams))
+
+		for i, upstream := range upstreams {
+			order[i] = i
+			load[i] = float64(outstandingOf(upstream)) / float64(weights[i])
+		}
+
+		// Shuffled first, so ties don't always go to the first upstream.
+		rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+		sort.SliceStable(order, func(i, j int) bool { return load[order[i]] < load[order[j]] })
+
+		return order
+
+	case strategyHash:
+		// hash_key is validated when the router is loaded.
+		target, _ := parseTarget(options.String("hash_key", "ip"))
+		key := newSubject(d.req, d.server.trusted).value(target)
+
+		return ringOf(upstreams, weights).lookup(key)
+	}
+
+	return weightedOrder(weights)
+}
+
+// weightedOrder picks indexes at random without replacement, the chance of
+// each index follows its weight.
+func weightedOrder(weights []int64) []int {
+	left := append([]int64{}, weights...)
+	order := []int{}
+
+	var total int64
+	for _, w := range left {
+		total += w
+	}
+
+	for len(order) < len(weights) {
+		r := rand.Int63n(total)
+
+		for i, w := range left {
+			if r < w {
+				order = append(order, i)
+				total -= w
+				left[i] = 0
+				break
+			}
+
+			r -= w
+		}
+	}
+
+	return order
+}
+
+// outstandingOf returns the number of requests in flight to the upstream.
+func outstandingOf(upstream string) int64 {
+	outstanding.Lock()
+	defer outstanding.Unlock()
+
+	return outstanding.counts[upstream]
+}
+
+// addOutstanding changes the number of requests in flight to the upstream.
+func addOutstanding(upstream string, delta int64) {
+	outstanding.Lock()
+	defer outstanding.Unlock()
+
+	if n := outstanding.counts[upstream] + delta; n > 0 {
+		outstanding.counts[upstream] = n
+	} else {
+		delete(outstanding.counts, upstream)
+	}
+}
+
+// balanceKey ...
+func balanceKey(upstreams []string, weights []int64) string {
+	var b strings.Builder
+
+	for i, upstream := range upstreams {
+		b.WriteString(upstream)
+		b.WriteByte('*')
+		b.WriteString(strconv.FormatInt(weights[i], 10))
+		b.WriteByte(',')
+	}
+
+	return b.String()
+}
+
+// roundRobin is smooth weighted round robin: every pick, each upstream gains
+// its weight and the one with the most wins and loses the total, eg: weights
+// 5, 1, 1 pick a a b a c a a.
+// refs:
+// https://github.com/phusion/nginx/commit/27e94984486058d73157038f7950a0a36ecc6e35
+type roundRobin struct {
+	mu      sync.Mutex
+	weights []int64
+	current []int64
+}
+
+// roundRobinOf ...
+func roundRobinOf(upstreams []string, weights []int64) *roundRobin {
+	v := roundRobins.loadOrStore(balanceKey(upstreams, weights), &roundRobin{
+		weights: weights,
+		current: make([]int64, len(weights)),
+	})
+
+	return v.(*roundRobin)
+}
+
+// next ...
+func (rr *roundRobin) next() int {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	best := 0
+
+	var total int64
+
+	for i, w := range rr.weights {
+		rr.current[i] += w
+		total += w
+
+		if rr.current[i] > rr.current[best] {
+			best = i
+		}
+	}
+
+	rr.current[best] -= total
+
+	return best
+}
+
+// ring is a consistent hash ring, a key keeps going to the same upstream as
+// long as it is in the list, and only the keys of an upstream move when it
+// is added or removed.
+type ring struct {
+	points []uint32
+	owners []int
+	count  int
+}
+
+// ringOf ...
+func ringOf(upstreams []string, weights []int64) *ring {
+	key := balanceKey(upstreams, weights)
+
+	if v, ok := rings.load(key); ok {
+		return v.(*ring)
+	}
+
+	type point struct {
+		hash  uint32
+		owner int
+	}
+
+	points := []point{}
+
+	for i, upstream := range upstreams {
+		for j := 0; j < hashReplicas*int(weights[i]); j++ {
+			points = append(points, point{hashString(upstream + "#" + strconv.Itoa(j)), i})
+		}
+	}
+
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	r := &ring{count: len(upstreams)}
+
+	for _, p := range points {
+		r.points = append(r.points, p.hash)
+		r.owners = append(r.owners, p.owner)
+	}
+
+	v := rings.loadOrStore(key, r)
+
+	return v.(*ring)
+}
+
+// lookup returns the upstreams in the order they come on the ring after the
+// key, the first one owns the key.
+func (r *ring) lookup(key string) []int {
+	h := hashString(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+
+	order := []int{}
+	seen := make([]bool, r.count)
+
+	for i := 0; i < len(r.points) && len(order) < r.count; i++ {
+		owner := r.owners[(start+i)%len(r.points)]
+
+		if !seen[owner] {
+			seen[owner] = true
+			order = append(order, owner)
+		}
+	}
+
+	return order
+}
+
+// hashString is FNV-1a with the finalizer of MurmurHash3, FNV alone puts
+// strings differing in the last bytes, eg: the points of an upstream, too
+// close on the ring.
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+
+	return x
+}
@@ -0,0 +1,86 @@
+package nginless
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru keeps the values used last, up to size of them. State keyed by the
+// rendered parameters of steps goes in one, so it can't grow without a bound.
+type lru struct {
+	mu      sync.Mutex
+	size    int
+	items   map[string]*list.Element
+	order   *list.List
+	evicted func(value interface{})
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+}
+
+// newLRU ...
+func newLRU(size int, evicted func(value interface{})) *lru {
+	return &lru{
+		size:    size,
+		items:   map[string]*list.Element{},
+		order:   list.New(),
+		evicted: evicted,
+	}
+}
+
+// load returns the value of key.
+func (c *lru) load(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*lruEntry).value, true
+	}
+
+	return nil, false
+}
+
+// loadOrStore returns the value of key, value is stored when there is none.
+func (c *lru) loadOrStore(key string, value interface{}) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return e.Value.(*lruEntry).value
+	}
+
+	c.add(key, value)
+
+	return value
+}
+
+// store sets the value of key.
+func (c *lru) store(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.order.Remove(e)
+		delete(c.items, key)
+	}
+
+	c.add(key, value)
+}
+
+func (c *lru) add(key string, value interface{}) {
+	c.items[key] = c.order.PushFront(&lruEntry{key, value})
+
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*lruEntry).key)
+
+		if c.evicted != nil {
+			c.evicted(e.Value.(*lruEntry).value)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package nginless
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// problem is a ConfigError with the line it was found at, 0 when unknown.
+type problem struct {
+	line int
+	err  *ConfigError
+}
+
+// Check validates the router config file and the files it refers to, and
+// prints every problem found with its line. It returns the exit code.
+//
+// nginless check -r ${router_yaml_file} -a ${action_script_folder}
+func Check(args []string) int {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	routerPath := fs.String("r", "", "Router config file path")
+	actionPath := fs.String("a", "", "Action files path")
+
+	fs.Parse(args)
+
+	problems := checkRouter(*routerPath, *actionPath)
+
+	for _, p := range problems {
+		if p.line > 0 {
+			fmt.Printf("%s:%d: %s\n", *routerPath, p.line, p.err)
+		} else {
+			fmt.Printf("%s: %s\n", *routerPath, p.err)
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		return 1
+	}
+
+	fmt.Printf("%s: ok\n", *routerPath)
+
+	return 0
+}
+
+// checkRouter ...
+func checkRouter(routerPath string, actionPath string) []problem {
+	bytes, err := ioutil.ReadFile(routerPath)
+	if err != nil {
+		return []problem{{0, &ConfigError{"", -1, err}}}
+	}
+
+	config, err := parseConfig(bytes)
+	if err != nil {
+		return []problem{{0, &ConfigError{"", -1, err}}}
+	}
+
+	lines := newConfigLines(bytes)
+	problems := []problem{}
+
+	// Conditions, regexes and servers.
+	_, errs := buildRouter(config)
+
+	for _, e := range errs {
+		problems = append(problems, problem{lines.rule(e.Server, e.Rule), e})
+	}
+
+	// Steps and certificates.
+	servers := map[string]ServerConfig{"": config.ServerConfig}
+
+	for name, c := range config.Servers {
+		servers[strings.ToLower(name)] = c
+	}
+
+	for name, c := range servers {
+		for i, rule := range c.Rules {
+			// Invalid steps are reported by buildRouter.
+			steps, err := parseDo(rule.Do.Value)
+			if err != nil {
+				continue
+			}
+
+			for _, step := range steps {
+				if err := checkStep(step, actionPath); err != nil {
+					problems = append(problems, problem{lines.rule(name, i), &ConfigError{name, i, err}})
+				}
+			}
+		}
+
+		steps, err := parseDo(c.Default.Value)
+		if err == nil {
+			for _, step := range steps {
+				if err := checkStep(step, actionPath); err != nil {
+					problems = append(problems, problem{lines.find(name, "default"), &ConfigError{name, -1, fmt.Errorf("default: %s", err)}})
+				}
+			}
+		}
+
+		// Invalid pages are reported by buildRouter.
+		pages, _ := parseErrorPages(c.ErrorPages)
+
+		for _, page := range pages {
+			for _, file := range []string{page.HTML, page.JSON} {
+				if _, err := os.Stat(file); file != "" && err != nil {
+					problems = append(problems, problem{lines.find(name, "error_pages"), &ConfigError{name, -1, fmt.Errorf("error page file %s not found", file)}})
+				}
+			}
+		}
+
+		for i, v := range c.Certificates {
+			if err := checkCertificate(v); err != nil {
+				problems = append(problems, problem{lines.find(name, "certificates", strconv.Itoa(i)), &ConfigError{name, -1, err}})
+			}
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].err.Server != problems[j].err.Server {
+			return problems[i].err.Server < problems[j].err.Server
+		}
+
+		return problems[i].line < problems[j].line
+	})
+
+	return problems
+}
+
+// checkStep checks what the schema of the action can't, eg: upstream URLs
+// and script files.
+func checkStep(step Step, actionPath string) error {
+	switch step.Action {
+	case "proxy", "balancing":
+		for _, v := range step.Parameters {
+			s := paramString(v)
+
+			// Rendered from captures at runtime.
+			if strings.Contains(s, "{{") {
+				continue
+			}
+
+			u, err := url.Parse(s)
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("%s: invalid upstream %q", step.Action, s)
+			}
+		}
+
+	case "call":
+		name := paramString(step.Parameters[0])
+
+		// Rendered from captures at runtime.
+		if strings.Contains(name, "{{") {
+			return nil
+		}
+
+		script := fmt.Sprintf("%s/%s.tengo", actionPath, name)
+
+		if _, err := os.Stat(script); err != nil {
+			return fmt.Errorf("call: action file %s not found", script)
+		}
+	}
+
+	return nil
+}
+
+// checkCertificate ...
+func checkCertificate(c Certificate) error {
+	if c.Certificate == "" || c.Key == "" {
+		return fmt.Errorf("certificate pair missing: certificate %q, key %q", c.Certificate, c.Key)
+	}
+
+	if _, err := tls.LoadX509KeyPair(c.Certificate, c.Key); err != nil {
+		return fmt.Errorf("load certificate pair %s, %s failed: %s", c.Certificate, c.Key, err)
+	}
+
+	return nil
+}
+
+// configLines finds lines of rules and sections in the router config file.
+type configLines struct {
+	root *yaml.Node
+}
+
+// newConfigLines ...
+func newConfigLines(bytes []byte) configLines {
+	doc := yaml.Node{}
+
+	if err := yaml.Unmarshal(bytes, &doc); err != nil || len(doc.Content) == 0 {
+		return configLines{}
+	}
+
+	return configLines{doc.Content[0]}
+}
+
+// rule returns the line of a rule, or of the server when rule is -1.
+func (l configLines) rule(server string, rule int) int {
+	if rule < 0 {
+		return l.find(server)
+	}
+
+	return l.find(server, "rules", strconv.Itoa(rule))
+}
+
+// find returns the line of the node at path under the server, the top-level
+// is the server "".
+func (l configLines) find(server string, path ...string) int {
+	if server != "" {
+		path = append([]string{"servers", server}, path...)
+	}
+
+	node := l.root
+	if node == nil {
+		return 0
+	}
+
+	for _, p := range path {
+		var next *yaml.Node
+
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if strings.EqualFold(node.Content[i].Value, p) {
+					next = node.Content[i+1]
+
+					// Point at the key, the value may span several lines.
+					if next.Kind != yaml.ScalarNode {
+						next = &yaml.Node{Kind: next.Kind, Content: next.Content, Line: node.Content[i].Line}
+					}
+
+					break
+				}
+			}
+
+		case yaml.SequenceNode:
+			i, err := strconv.Atoi(p)
+			if err == nil && i < len(node.Content) {
+				next = node.Content[i]
+			}
+		}
+
+		if next == nil {
+			return node.Line
+		}
+
+		node = next
+	}
+
+	return node.Line
+}
@@ -0,0 +1,524 @@
+package nginless
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/duanckham/go-pcre"
+)
+
+// reNamedGroup finds `(?<name>`, `(?P<name>` and `(?'name'` in a pattern.
+var reNamedGroup = regexp.MustCompile(`\(\?(?:P?<|')([A-Za-z_][A-Za-z0-9_]*)[>']`)
+
+// Operators of condition nodes.
+const (
+	opTest = "test"
+	opAll  = "all"
+	opAny  = "any"
+	opNot  = "not"
+)
+
+// Clause is a matching condition in the router config. A clause with `rule`
+// or `test` tests one target, `all`, `any` and `not` combine other clauses,
+// and everything set on the same clause has to match.
+//
+// A test without `rule` only requires the target to be non-empty, eg: the
+// header is present.
+type Clause struct {
+	Condition interface{} `yaml:"rule"`
+	Test      string      `yaml:"test"`
+	All       []Clause    `yaml:"all"`
+	Any       []Clause    `yaml:"any"`
+	Not       *Clause     `yaml:"not"`
+}
+
+// Target $A.$B, eg: header.user-agent.
+type Target struct {
+	A string
+	B string
+}
+
+// Targets with a name, eg: header.user-agent.
+var namedTargets = map[string]bool{
+	"header": true,
+	"query":  true,
+	"cookie": true,
+}
+
+// Targets without a name, `url` is the host followed by the URI.
+var plainTargets = map[string]bool{
+	"url":    true,
+	"host":   true,
+	"path":   true,
+	"method": true,
+	"scheme": true,
+	"sni":    true,
+	"ip":     true,
+}
+
+// Pattern is a compiled regex with the names of its named groups.
+//
+// Literal is the leading literal text of the pattern, subjects matching an
+// Anchored pattern start with it. Required is a literal text every subject
+// matching the pattern contains.
+type Pattern struct {
+	Source   string
+	Regexp   pcre.Regexp
+	Names    []string
+	Literal  string
+	Required string
+	Anchored bool
+	Exact    bool
+}
+
+// Node is a compiled Clause, tests on `ip` use Networks instead of Regex.
+type Node struct {
+	Op       string
+	Target   Target
+	Regex    []Pattern
+	Networks []*net.IPNet
+	Children []Node
+}
+
+// compileClause ...
+func compileClause(c Clause) (Node, error) {
+	nodes := []Node{}
+	errs := []error{}
+
+	if c.Condition != nil || c.Test != "" {
+		node, err := compileTest(c)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if len(c.All) > 0 {
+		node, err := compileClauses(opAll, c.All)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if len(c.Any) > 0 {
+		node, err := compileClauses(opAny, c.Any)
+		if err != nil {
+			errs = append(errs, err)
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	if c.Not != nil {
+		child, err := compileClause(*c.Not)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("not: %s", err))
+		}
+
+		nodes = append(nodes, Node{Op: opNot, Children: []Node{child}})
+	}
+
+	if len(errs) > 0 {
+		return Node{}, joinErrors(errs)
+	}
+
+	switch len(nodes) {
+	case 0:
+		// Nothing to test, matches every request.
+		return Node{Op: opAll}, nil
+	case 1:
+		return nodes[0], nil
+	}
+
+	return Node{Op: opAll, Children: nodes}, nil
+}
+
+// compileClauses ...
+func compileClauses(op string, clauses []Clause) (Node, error) {
+	node := Node{Op: op}
+	errs := []error{}
+
+	for i, c := range clauses {
+		child, err := compileClause(c)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %d: %s", op, i, err))
+		}
+
+		node.Children = append(node.Children, child)
+	}
+
+	if len(errs) > 0 {
+		return Node{}, joinErrors(errs)
+	}
+
+	return node, nil
+}
+
+// compileTest ...
+func compileTest(c Clause) (Node, error) {
+	node := Node{
+		Op:    opTest,
+		Regex: []Pattern{},
+	}
+
+	// Process target.
+	target, err := parseTarget(c.Test)
+	if err != nil {
+		return Node{}, err
+	}
+
+	node.Target = target
+
+	// Process condition.
+	conditions, err := toStrings(c.Condition)
+	if err != nil {
+		return Node{}, fmt.Errorf("invalid `rule`: %s", err)
+	}
+
+	errs := []error{}
+
+	for _, v := range conditions {
+		if target.A == "ip" {
+			network, err := parseNetwork(v)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			node.Networks = append(node.Networks, network)
+			continue
+		}
+
+		pattern, err := compilePattern(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("compile regex failed: %s", err))
+			continue
+		}
+
+		node.Regex = append(node.Regex, pattern)
+	}
+
+	if len(errs) > 0 {
+		return Node{}, joinErrors(errs)
+	}
+
+	return node, nil
+}
+
+// joinErrors ...
+func joinErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+
+	s := make([]string, len(errs))
+
+	for i, err := range errs {
+		s[i] = err.Error()
+	}
+
+	return errors.New(strings.Join(s, "; "))
+}
+
+// parseTarget ...
+func parseTarget(test string) (Target, error) {
+	if test == "" {
+		return Target{"url", ""}, nil
+	}
+
+	t := strings.SplitN(test, ".", 2)
+
+	switch {
+	case len(t) == 2 && namedTargets[t[0]] && t[1] != "":
+		return Target{t[0], t[1]}, nil
+	case len(t) == 1 && plainTargets[t[0]]:
+		return Target{t[0], ""}, nil
+	case namedTargets[t[0]]:
+		return Target{}, fmt.Errorf("the matching condition for %s is invalid, the correct `test` should be `%s.$something`", t[0], t[0])
+	}
+
+	return Target{}, fmt.Errorf("unknown `test` %s", test)
+}
+
+// parseNetwork accepts a CIDR or a single address.
+func parseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, "/") {
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %s", s)
+		}
+
+		return network, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %s", s)
+	}
+
+	bits := 8 * net.IPv4len
+	if ip.To4() == nil {
+		bits = 8 * net.IPv6len
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// compilePattern ...
+func compilePattern(source string) (Pattern, error) {
+	regex, err := pcre.Compile(source, 0)
+	if err != nil {
+		return Pattern{}, err
+	}
+
+	names := []string{}
+
+	for _, m := range reNamedGroup.FindAllStringSubmatch(source, -1) {
+		names = append(names, m[1])
+	}
+
+	literal, anchored, exact := extractLiteral(source)
+
+	return Pattern{source, regex, names, literal, requiredLiteral(source), anchored, exact}, nil
+}
+
+// match evaluates the node against the request and collects the captured
+// groups, groups captured under `not` are dropped.
+func (node *Node) match(sub *subject) (map[string]string, bool) {
+	switch node.Op {
+	case opTest:
+		s := sub.value(node.Target)
+
+		if len(node.Networks) > 0 {
+			ip := net.ParseIP(s)
+
+			for _, network := range node.Networks {
+				if ip != nil && network.Contains(ip) {
+					return map[string]string{}, true
+				}
+			}
+
+			return nil, false
+		}
+
+		if len(node.Regex) == 0 {
+			return map[string]string{}, s != ""
+		}
+
+		for _, pattern := range node.Regex {
+			if params, ok := pattern.match(s); ok {
+				return params, true
+			}
+		}
+
+	case opAll:
+		params := map[string]string{}
+
+		for _, child := range node.Children {
+			p, ok := child.match(sub)
+			if !ok {
+				return nil, false
+			}
+
+			for k, v := range p {
+				params[k] = v
+			}
+		}
+
+		return params, true
+
+	case opAny:
+		for _, child := range node.Children {
+			if params, ok := child.match(sub); ok {
+				return params, true
+			}
+		}
+
+	case opNot:
+		if _, ok := node.Children[0].match(sub); !ok {
+			return map[string]string{}, true
+		}
+	}
+
+	return nil, false
+}
+
+// trace evaluates the node as match does, and appends the result of every
+// test to lines. It explains why a rule matched or not.
+func (node *Node) trace(sub *subject, indent string, lines *[]string) bool {
+	mark := func(ok bool) string {
+		if ok {
+			return "ok"
+		}
+
+		return "--"
+	}
+
+	if node.Op == opTest {
+		_, ok := node.match(sub)
+		*lines = append(*lines, fmt.Sprintf("%s[%s] %s (value %q)", indent, mark(ok), node.describe(), sub.value(node.Target)))
+
+		return ok
+	}
+
+	if node.Op == opAll && len(node.Children) == 0 {
+		*lines = append(*lines, fmt.Sprintf("%s[ok] (no condition)", indent))
+		return true
+	}
+
+	// Children are traced after the line of the node, the result is known then.
+	i := len(*lines)
+	*lines = append(*lines, "")
+
+	results := []bool{}
+
+	for j := range node.Children {
+		results = append(results, node.Children[j].trace(sub, indent+"    ", lines))
+	}
+
+	ok := false
+
+	switch node.Op {
+	case opAll:
+		ok = true
+
+		for _, r := range results {
+			ok = ok && r
+		}
+
+	case opAny:
+		for _, r := range results {
+			ok = ok || r
+		}
+
+	case opNot:
+		ok = !results[0]
+	}
+
+	(*lines)[i] = fmt.Sprintf("%s[%s] %s", indent, mark(ok), node.Op)
+
+	return ok
+}
+
+// describe ...
+func (node *Node) describe() string {
+	target := node.Target.A
+	if node.Target.B != "" {
+		target += "." + node.Target.B
+	}
+
+	conditions := []string{}
+
+	for _, p := range node.Regex {
+		conditions = append(conditions, p.Source)
+	}
+
+	for _, n := range node.Networks {
+		conditions = append(conditions, n.String())
+	}
+
+	if len(conditions) == 0 {
+		return target + " is present"
+	}
+
+	return target + " ~ " + strings.Join(conditions, " | ")
+}
+
+// subject is a request being matched, it caches the values of targets which
+// are costly to build.
+type subject struct {
+	req     *http.Request
+	trusted []*net.IPNet
+	url     string
+	query   url.Values
+}
+
+// newSubject ...
+func newSubject(req *http.Request, trusted []*net.IPNet) *subject {
+	return &subject{req: req, trusted: trusted}
+}
+
+// value returns the part of the request the target points to.
+func (sub *subject) value(t Target) string {
+	req := sub.req
+
+	switch t.A {
+	case "header":
+		return req.Header.Get(t.B)
+	case "query":
+		if sub.query == nil {
+			sub.query = req.URL.Query()
+		}
+
+		return sub.query.Get(t.B)
+	case "cookie":
+		cookie, err := req.Cookie(t.B)
+		if err != nil {
+			return ""
+		}
+
+		return cookie.Value
+	case "host":
+		return requestHost(req)
+	case "path":
+		return req.URL.Path
+	case "method":
+		return req.Method
+	case "scheme":
+		return requestScheme(req)
+	case "sni":
+		if req.TLS == nil {
+			return ""
+		}
+
+		return req.TLS.ServerName
+	case "ip":
+		return clientIP(req, sub.trusted)
+	}
+
+	if sub.url == "" {
+		sub.url = req.Host + req.URL.String()
+	}
+
+	return sub.url
+}
+
+// match runs the pattern against s and collects the captured groups.
+func (p *Pattern) match(s string) (map[string]string, bool) {
+	// Skip the regex when the required literal is missing.
+	if p.Anchored && !strings.HasPrefix(s, p.Literal) || !strings.Contains(s, p.Required) {
+		return nil, false
+	}
+
+	m := p.Regexp.MatcherString(s, 0)
+	if !m.Matches {
+		return nil, false
+	}
+
+	params := map[string]string{}
+
+	for i := 0; i <= m.Groups; i++ {
+		if m.Present(i) {
+			params[strconv.Itoa(i)] = m.GroupString(i)
+		}
+	}
+
+	for _, name := range p.Names {
+		if m.NamedPresent(name) {
+			params[name], _ = m.NamedString(name)
+		}
+	}
+
+	return params, true
+}
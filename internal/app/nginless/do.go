@@ -1,19 +1,59 @@
 package nginless
 
 import (
+	"bufio"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
+
+	"github.com/duanckham/nginless/internal/app/common/utils"
 )
 
-// D ...
+// D is the context of a request going through the steps of a rule. Steps
+// before the terminal one change req for the steps after them, and register
+// hooks on res to change the response.
 type D struct {
 	req      *http.Request
-	res      http.ResponseWriter
+	res      *responseWriter
+	server   *Server
+	params   map[string]string
+	next     bool
 	finished bool
 }
 
+// newD ...
+func newD(req *http.Request, w http.ResponseWriter, server *Server, params map[string]string) *D {
+	return &D{
+		req:    req,
+		res:    &responseWriter{ResponseWriter: w},
+		server: server,
+		params: params,
+	}
+}
+
+// onResponse registers a hook to run right before the response header is
+// written, whichever step writes it.
+func (d *D) onResponse(hook func(status int, header http.Header)) {
+	d.res.hooks = append(d.res.hooks, hook)
+}
+
 func (d *D) returnInternalServerError() *D {
+	return d.returnError(http.StatusInternalServerError)
+}
+
+func (d *D) returnNotFound() *D {
+	return d.returnError(http.StatusNotFound)
+}
+
+// returnError finishes the response with the status, using the error page of
+// the server for it when there is one.
+func (d *D) returnError(status int) *D {
 	if !d.finished {
-		d.res.WriteHeader(http.StatusInternalServerError)
+		if !d.writeErrorPage(status) {
+			d.res.WriteHeader(status)
+		}
+
 		d.finished = true
 	}
 
@@ -25,28 +65,224 @@ func (d *D) done() *D {
 	return d
 }
 
+// paramString ...
+func paramString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+
+	return fmt.Sprint(v)
+}
+
+// vars returns the variables parameters can use: the groups captured by the
+// matched rule and the request, as changed by the steps so far.
+func (d *D) vars() map[string]string {
+	vars := map[string]string{
+		"remote_addr": remoteIP(d.req),
+		"client_ip":   clientIP(d.req, d.server.trusted),
+		"host":        requestHost(d.req),
+		"method":      d.req.Method,
+		"scheme":      requestScheme(d.req),
+		"path":        d.req.URL.Path,
+		"query":       d.req.URL.RawQuery,
+		"uri":         d.req.URL.RequestURI(),
+	}
+
+	// Captures take precedence.
+	for k, v := range d.params {
+		vars[k] = v
+	}
+
+	return vars
+}
+
+// render fills variables into the parameters, eg: proxy(http://backend-{{id}}:8080).
+func (d *D) render(parameters []interface{}) []interface{} {
+	rendered := make([]interface{}, len(parameters))
+
+	var vars map[string]string
+
+	for i, v := range parameters {
+		if s, ok := v.(string); ok && strings.Contains(s, "{{") {
+			if vars == nil {
+				vars = d.vars()
+			}
+
+			rendered[i] = utils.Render(s, vars)
+		} else {
+			rendered[i] = v
+		}
+	}
+
+	return rendered
+}
+
+// renderOptions fills variables into the string options, options without
+// variables are returned as is.
+func (d *D) renderOptions(options StepOptions) StepOptions {
+	var rendered StepOptions
+
+	for k, v := range options {
+		if s, ok := v.(string); ok && strings.Contains(s, "{{") {
+			if rendered == nil {
+				rendered = StepOptions{}
+
+				for k, v := range options {
+					rendered[k] = v
+				}
+			}
+
+			rendered[k] = utils.Render(s, d.vars())
+		}
+	}
+
+	if rendered == nil {
+		return options
+	}
+
+	return rendered
+}
+
 func (n *Nginless) do(d *D, step Step) *D {
+	raw := step.Options
+	parameters := d.render(step.Parameters)
+	step.Options = d.renderOptions(step.Options)
+
 	switch step.Action {
 	// eg:
 	// proxy($remote_address)
 	case "proxy":
-		return n.doProxy(d, step.Parameters)
+		return n.doProxy(d, parameters, step.Options)
 
 	// eg:
 	// balancing($remote_address, ...$remote_address)
 	case "balancing":
-		return n.doBalancing(d, step.Parameters)
+		return n.doBalancing(d, parameters, step.Options)
 
 	// eg:
 	// call($tengo_script)
 	case "call":
-		return n.doCall(d, step.Parameters)
+		return n.doCall(d, parameters)
 
 	// eg:
 	// json({"a":"b"})
 	case "json":
-		return n.doJSON(d, step.Parameters)
+		return n.doJSON(d, parameters)
+
+	// eg:
+	// redirect(301, https://www.testing.test/{{1}})
+	case "redirect":
+		return n.doRedirect(d, parameters)
+
+	// eg:
+	// respond(410, text/plain, "{{path}} is gone")
+	case "respond":
+		// The file is rendered by doRespond, which checks the variables in it.
+		return n.doRespond(d, parameters, raw)
+
+	// eg:
+	// rewrite(^/old/(.*), /new/$1)
+	case "rewrite":
+		return n.doRewrite(d, parameters)
+
+	// eg:
+	// static(./www/{{tenant}}, index.html, fallback=index.html)
+	case "static":
+		// The root is rendered by doStatic, which checks the variables in it.
+		return n.doStatic(d, step.Parameters, step.Options)
+
+	// eg:
+	// set_header(X-Real-IP, {{remote_addr}})
+	case "set_header":
+		return n.doSetHeader(d, parameters)
+
+	// eg:
+	// add_header(X-Tag, {{tenant}})
+	case "add_header":
+		return n.doAddHeader(d, parameters)
+
+	// eg:
+	// remove_header(Cookie, Authorization)
+	case "remove_header":
+		return n.doRemoveHeader(d, parameters)
+
+	// eg:
+	// set_response_header(Cache-Control, no-store)
+	case "set_response_header":
+		return n.doSetResponseHeader(d, parameters)
+
+	// eg:
+	// add_response_header(Set-Cookie, seen=1)
+	case "add_response_header":
+		return n.doAddResponseHeader(d, parameters)
+
+	// eg:
+	// remove_response_header(Server, X-Powered-By)
+	case "remove_response_header":
+		return n.doRemoveResponseHeader(d, parameters)
 	}
 
 	return d
 }
+
+// responseWriter runs the hooks registered by steps before writing the header.
+type responseWriter struct {
+	http.ResponseWriter
+	hooks       []func(status int, header http.Header)
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader ...
+func (w *responseWriter) WriteHeader(status int) {
+	if w.commit(status) {
+		w.ResponseWriter.WriteHeader(status)
+	}
+}
+
+// commit runs the hooks for the status once, it reports false when the
+// header is written already.
+func (w *responseWriter) commit(status int) bool {
+	if w.wroteHeader {
+		return false
+	}
+
+	w.wroteHeader = true
+	w.status = status
+
+	for _, hook := range w.hooks {
+		hook(status, w.Header())
+	}
+
+	return true
+}
+
+// Write ...
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Hijack hands the connection over to the caller, eg: for upgrades.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the connection can't be hijacked")
+	}
+
+	return h.Hijack()
+}
+
+// Flush ...
+func (w *responseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -1,18 +1,49 @@
 package nginless
 
 import (
-	"math/rand"
+	"net/http"
+
+	"go.uber.org/zap"
 )
 
-// doBalancing forward the request to the random address.
+// doBalancing forward the request to one of the addresses, picked by the
+// strategy of the step. The next one is tried when it can't be reached, it
+// is a 503 when none can.
 // eg:
 // balancing(https://www.google.com, https://www.youtube.com)
-func (n *Nginless) doBalancing(d *D, parameters []interface{}) *D {
+// balancing(http://a, http://b, strategy=round_robin, weights="3, 1")
+// balancing(http://a, http://b, strategy=hash, hash_key=cookie.session)
+func (n *Nginless) doBalancing(d *D, parameters []interface{}, options StepOptions) *D {
 	if len(parameters) == 0 {
 		return d.returnInternalServerError()
 	}
 
-	return n.doProxy(d, []interface{}{
-		parameters[rand.Intn(len(parameters))],
-	})
+	upstreams := make([]string, len(parameters))
+
+	for i, v := range parameters {
+		upstreams[i] = paramString(v)
+	}
+
+	for _, i := range balanceOrder(d, upstreams, options) {
+		addOutstanding(upstreams[i], 1)
+
+		res, perr := n.sendUpstream(d, upstreams[i], options)
+		if perr == nil {
+			d = n.writeUpstream(d, res, options)
+			addOutstanding(upstreams[i], -1)
+
+			return d
+		}
+
+		addOutstanding(upstreams[i], -1)
+		n.logProxyError(".doBalancing", perr)
+
+		if !perr.down() {
+			return d.returnError(perr.Status)
+		}
+	}
+
+	n.logger.Error(".doBalancing every upstream is down", zap.Any("upstreams", parameters))
+
+	return d.returnError(http.StatusServiceUnavailable)
 }
@@ -18,7 +18,11 @@ import (
 
 // doCall ...
 func (n *Nginless) doCall(d *D, parameters []interface{}) *D {
-	actionFile, err := ioutil.ReadFile(fmt.Sprintf("%s/%s.tengo", n.actions, parameters[0].(string)))
+	if len(parameters) == 0 {
+		return d.returnInternalServerError()
+	}
+
+	actionFile, err := ioutil.ReadFile(fmt.Sprintf("%s/%s.tengo", n.actions, paramString(parameters[0])))
 	if err != nil {
 		d.returnInternalServerError()
 		return d
@@ -32,6 +36,14 @@ func (n *Nginless) doCall(d *D, parameters []interface{}) *D {
 
 	script.Add("fetch", fetchFunc)
 
+	// next() hands the request over to the steps after this one.
+	script.Add("next", &tengo.UserFunction{
+		Name: "next",
+		Value: func(args ...tengo.Object) (tengo.Object, error) {
+			d.next = true
+			return nil, nil
+		}})
+
 	script.SetImports(stdlib.GetModuleMap(stdlib.AllModuleNames()...))
 
 	_, err = script.RunContext(context.Background())
@@ -40,7 +52,13 @@ func (n *Nginless) doCall(d *D, parameters []interface{}) *D {
 		d.returnInternalServerError()
 	}
 
-	return d
+	// The script is the terminal step unless it called next().
+	if d.next && !d.finished {
+		d.next = false
+		return d
+	}
+
+	return d.done()
 }
 
 // createReqModule ...
@@ -65,12 +83,46 @@ func createReqModule(d *D) map[string]tengo.Object {
 		}
 	}
 
+	// Process groups captured by the rule.
+	params := map[string]tengo.Object{}
+
+	for k, v := range d.params {
+		params[k] = &tengo.String{Value: v}
+	}
+
 	return map[string]tengo.Object{
 		"method":  &tengo.String{Value: d.req.Method},
 		"host":    &tengo.String{Value: d.req.Host},
 		"path":    &tengo.String{Value: d.req.URL.Path},
 		"queries": &tengo.Map{Value: queries},
 		"headers": &tengo.Map{Value: headers},
+		"params":  &tengo.Map{Value: params},
+		// Changes are seen by the steps after next().
+		"set_header": &tengo.UserFunction{
+			Name: "set_header",
+			Value: func(args ...tengo.Object) (tengo.Object, error) {
+				if len(args) != 2 {
+					return nil, tengo.ErrWrongNumArguments
+				}
+
+				k, _ := tengo.ToString(args[0])
+				v, _ := tengo.ToString(args[1])
+				d.req.Header.Set(k, v)
+
+				return nil, nil
+			}},
+		"del_header": &tengo.UserFunction{
+			Name: "del_header",
+			Value: func(args ...tengo.Object) (tengo.Object, error) {
+				if len(args) != 1 {
+					return nil, tengo.ErrWrongNumArguments
+				}
+
+				k, _ := tengo.ToString(args[0])
+				d.req.Header.Del(k)
+
+				return nil, nil
+			}},
 	}
 }
 
@@ -158,11 +210,11 @@ var fetchFunc = &tengo.UserFunction{
 		}
 
 		var (
-			reader  interface{} = nil
-			arg                 = args[0]
-			uri                 = ""
-			method              = "GET"
-			headers             = map[string]string{}
+			reader  io.Reader = nil
+			arg               = args[0]
+			uri               = ""
+			method            = "GET"
+			headers           = map[string]string{}
 		)
 
 		switch arg.TypeName() {
@@ -210,7 +262,7 @@ var fetchFunc = &tengo.UserFunction{
 			}
 		}
 
-		req, err := http.NewRequest(method, uri, reader.(io.Reader))
+		req, err := http.NewRequest(method, uri, reader)
 		if err != nil {
 			return nil, err
 		}
@@ -220,13 +272,18 @@ var fetchFunc = &tengo.UserFunction{
 			req.Header.Add(k, item)
 		}
 
-		client := &http.Client{}
+		client := &http.Client{Transport: upstreamTransports.get(req.URL)}
 		res, err := client.Do(req)
 		if err != nil {
 			return nil, err
 		}
 
-		body, _ := ioutil.ReadAll(res.Body)
+		defer res.Body.Close()
+
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
 
 		return &tengo.Map{
 			Value: map[string]tengo.Object{
@@ -0,0 +1,89 @@
+package nginless
+
+import (
+	"net/http"
+)
+
+// doSetHeader sets a header of the request for the steps after it.
+// eg:
+// set_header(X-Real-IP, {{remote_addr}})
+func (n *Nginless) doSetHeader(d *D, parameters []interface{}) *D {
+	name := http.CanonicalHeaderKey(paramString(parameters[0]))
+	value := paramString(parameters[1])
+
+	// Go keeps the host out of the header map.
+	if name == "Host" {
+		d.req.Host = value
+		return d
+	}
+
+	d.req.Header.Set(name, value)
+
+	return d
+}
+
+// doAddHeader adds a value to a header of the request.
+// eg:
+// add_header(X-Tag, {{tenant}})
+func (n *Nginless) doAddHeader(d *D, parameters []interface{}) *D {
+	d.req.Header.Add(paramString(parameters[0]), paramString(parameters[1]))
+	return d
+}
+
+// doRemoveHeader removes headers from the request.
+// eg:
+// remove_header(Cookie, Authorization)
+func (n *Nginless) doRemoveHeader(d *D, parameters []interface{}) *D {
+	for _, v := range parameters {
+		d.req.Header.Del(paramString(v))
+	}
+
+	return d
+}
+
+// doSetResponseHeader sets a header of the response, whichever step writes it.
+// eg:
+// set_response_header(Cache-Control, no-store)
+func (n *Nginless) doSetResponseHeader(d *D, parameters []interface{}) *D {
+	name := paramString(parameters[0])
+	value := paramString(parameters[1])
+
+	d.onResponse(func(status int, header http.Header) {
+		header.Set(name, value)
+	})
+
+	return d
+}
+
+// doAddResponseHeader adds a value to a header of the response.
+// eg:
+// add_response_header(Set-Cookie, seen=1)
+func (n *Nginless) doAddResponseHeader(d *D, parameters []interface{}) *D {
+	name := paramString(parameters[0])
+	value := paramString(parameters[1])
+
+	d.onResponse(func(status int, header http.Header) {
+		header.Add(name, value)
+	})
+
+	return d
+}
+
+// doRemoveResponseHeader removes headers from the response.
+// eg:
+// remove_response_header(Server, X-Powered-By)
+func (n *Nginless) doRemoveResponseHeader(d *D, parameters []interface{}) *D {
+	names := []string{}
+
+	for _, v := range parameters {
+		names = append(names, paramString(v))
+	}
+
+	d.onResponse(func(status int, header http.Header) {
+		for _, name := range names {
+			header.Del(name)
+		}
+	})
+
+	return d
+}
@@ -2,10 +2,14 @@ package nginless
 
 // doJSON ...
 func (n *Nginless) doJSON(d *D, parameters []interface{}) *D {
-	s := parameters[0].(string)
+	if len(parameters) == 0 {
+		return d.returnInternalServerError()
+	}
+
+	s := paramString(parameters[0])
 
 	d.res.Header().Add("Content-Type", "application/json")
 	d.res.Write([]byte(s))
 
-	return d
+	return d.done()
 }
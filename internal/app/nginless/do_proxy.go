@@ -2,44 +2,125 @@ package nginless
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/valyala/bytebufferpool"
 	"go.uber.org/zap"
 )
 
+// proxyError is a failed attempt to get a response from an upstream, Class is
+// one of connect, timeout, tls, protocol, canceled or invalid.
+type proxyError struct {
+	Upstream string
+	Class    string
+	Status   int
+	Err      error
+	Elapsed  time.Duration
+	// Connected tells whether a connection to the upstream was made.
+	Connected bool
+}
+
+// down reports whether the upstream couldn't be reached at all, the request
+// was not sent and another upstream can be tried. A timeout is down when it
+// happened before the upstream was connected, eg: while dialing.
+func (e *proxyError) down() bool {
+	switch e.Class {
+	case "connect":
+		return true
+	case "timeout":
+		return !e.Connected
+	}
+
+	return false
+}
+
 // doProxy forward the request to the specified address.
 // eg:
 // proxy(https://www.google.com)
 // proxy(http://1.2.3.4:8000)
+// proxy(http://1.2.3.4:8000, timeout=10s, intercept_errors=true)
+// proxy(http://svc/internal, strip_prefix=/api/v1, preserve_host=true)
+// proxy(ws://chat:8080, idle_timeout=5m)
 // refs:
 // https://sourcegraph.com/github.com/golang/go/-/blob/src/net/http/httputil/reverseproxy.go?L214
-func (n *Nginless) doProxy(d *D, parameters []interface{}) *D {
+func (n *Nginless) doProxy(d *D, parameters []interface{}, options StepOptions) *D {
 	if len(parameters) == 0 {
 		return d.returnInternalServerError()
 	}
 
-	remote, err := url.Parse(parameters[0].(string))
-	if err != nil {
-		return d.returnInternalServerError()
+	res, perr := n.sendUpstream(d, paramString(parameters[0]), options)
+	if perr != nil {
+		n.logProxyError(".doProxy", perr)
+		return d.returnError(perr.Status)
 	}
 
-	// Create request client.
-	client := &http.Client{}
+	return n.writeUpstream(d, res, options)
+}
+
+// sendUpstream sends the request to the upstream and returns its response.
+func (n *Nginless) sendUpstream(d *D, upstream string, options StepOptions) (*http.Response, *proxyError) {
+	start := time.Now()
+	connected := false
+
+	fail := func(class string, status int, err error) *proxyError {
+		return &proxyError{upstream, class, status, err, time.Since(start), connected}
+	}
+
+	remote, err := url.Parse(upstream)
+	if err != nil || remote.Scheme == "" || remote.Host == "" {
+		return nil, fail("invalid", http.StatusInternalServerError, fmt.Errorf("invalid upstream %q", upstream))
+	}
+
+	// WebSocket upstreams are reached over HTTP.
+	switch remote.Scheme {
+	case "ws":
+		remote.Scheme = "http"
+	case "wss":
+		remote.Scheme = "https"
+	}
+
+	// Create request client, connections are pooled by upstream.
+	client := &http.Client{
+		Transport: upstreamTransports.get(remote),
+		Timeout:   options.Duration("timeout", 0),
+	}
+
+	// The timeout would cut off the tunnel, idle_timeout applies instead.
+	upgrade := upgradeType(d.req.Header)
+	if upgrade != "" {
+		client.Timeout = 0
+	}
 
 	// Build up URI.
-	uri := fmt.Sprintf("%s://%s%s", remote.Scheme, remote.Host, d.req.RequestURI)
+	uri := upstreamURI(remote, d.req.URL, options.String("strip_prefix", ""))
+
+	// A failed attempt must not close the body, another upstream may be tried.
+	body := d.req.Body
+	if body != nil && body != http.NoBody {
+		body = ioutil.NopCloser(body)
+	}
 
 	// Build request.
-	req, err := http.NewRequest(d.req.Method, uri, d.req.Body)
+	req, err := http.NewRequest(d.req.Method, uri, body)
 	if err != nil {
-		n.logger.Error(".doProxy create new request failed", zap.Error(err))
+		return nil, fail("invalid", http.StatusInternalServerError, err)
 	}
 
+	// The body is streamed to the upstream, trailers of the client follow it.
+	req.ContentLength = d.req.ContentLength
+	req.Trailer = d.req.Trailer
+
 	// Copy request headers.
 	for k, headers := range d.req.Header {
 		for _, item := range headers {
@@ -47,11 +128,112 @@ func (n *Nginless) doProxy(d *D, parameters []interface{}) *D {
 		}
 	}
 
+	removeHopHeaders(req.Header)
+
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
+	}
+
+	// gRPC needs to tell the upstream it takes trailers.
+	if strings.Contains(strings.ToLower(d.req.Header.Get("Te")), "trailers") {
+		req.Header.Set("Te", "trailers")
+	}
+	setForwardedHeaders(req.Header, d.req, d.server.trusted)
+
+	if options.Bool("via", false) {
+		addVia(req.Header, d.req.ProtoMajor, d.req.ProtoMinor)
+	}
+
+	// Go sends the Host header from req.Host, the host of the upstream URL
+	// when it is empty. preserve_host sends the host of the client instead.
+	if options.Bool("preserve_host", false) {
+		req.Host = d.req.Host
+	}
+
+	if host := options.String("host", ""); host != "" {
+		req.Host = host
+	}
+
+	// Balancing tries the next upstream on a timeout before this.
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) {
+			connected = true
+		},
+	}
+
 	// Send to remote server.
-	res, err := client.Do(req)
+	res, err := client.Do(req.WithContext(httptrace.WithClientTrace(d.req.Context(), trace)))
 	if err != nil {
-		n.logger.Error(".doProxy send request to remote failed", zap.Error(err))
-		return d.returnInternalServerError()
+		class, status := classifyProxyError(err)
+		return nil, fail(class, status, err)
+	}
+
+	return res, nil
+}
+
+// upstreamURI returns the URI of the request on the upstream: the path of
+// the upstream followed by the path of the request without prefix, and the
+// queries of both.
+// eg:
+// http://svc/internal + /api/v1/users?id=1 - /api/v1 = http://svc/internal/users?id=1
+func upstreamURI(remote *url.URL, u *url.URL, prefix string) string {
+	path := u.EscapedPath()
+
+	if prefix != "" && hasPathPrefix(path, prefix) {
+		path = path[len(prefix):]
+
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+	}
+
+	if base := strings.TrimSuffix(remote.EscapedPath(), "/"); base != "" {
+		path = base + path
+	}
+
+	query := u.RawQuery
+
+	if remote.RawQuery != "" {
+		query = strings.Trim(remote.RawQuery+"&"+query, "&")
+	}
+
+	uri := fmt.Sprintf("%s://%s%s", remote.Scheme, remote.Host, path)
+
+	if query != "" {
+		uri += "?" + query
+	}
+
+	return uri
+}
+
+// hasPathPrefix reports whether path starts with the segments of prefix, eg:
+// /api/v1 is a prefix of /api/v1 and /api/v1/users but not of /api/v10.
+func hasPathPrefix(path string, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+// writeUpstream writes the response of the upstream to the client.
+func (n *Nginless) writeUpstream(d *D, res *http.Response, options StepOptions) *D {
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusSwitchingProtocols {
+		return n.writeUpgrade(d, res, options)
+	}
+
+	// Replace error responses of the upstream with the error pages.
+	if options.Bool("intercept_errors", false) && res.StatusCode >= 400 && findErrorPage(d.server.ErrorPages, res.StatusCode) != nil {
+		return d.returnError(res.StatusCode)
+	}
+
+	removeHopHeaders(res.Header)
+
+	if options.Bool("via", false) {
+		addVia(res.Header, res.ProtoMajor, res.ProtoMinor)
 	}
 
 	// Copy response headers.
@@ -60,9 +242,24 @@ func (n *Nginless) doProxy(d *D, parameters []interface{}) *D {
 			continue
 		}
 
+		d.res.Header().Del(k)
+
 		for _, item := range headers {
-			d.res.Header().Set(k, item)
+			d.res.Header().Add(k, item)
+		}
+	}
+
+	// Announce the trailers, they are sent after the body.
+	announced := len(res.Trailer)
+
+	if announced > 0 {
+		names := make([]string, 0, announced)
+
+		for k := range res.Trailer {
+			names = append(names, k)
 		}
+
+		d.res.Header().Set("Trailer", strings.Join(names, ", "))
 	}
 
 	// Write status code.
@@ -70,21 +267,79 @@ func (n *Nginless) doProxy(d *D, parameters []interface{}) *D {
 	// https://stackoverflow.com/a/26097384
 	d.res.WriteHeader(res.StatusCode)
 
+	var dst io.Writer = d.res
+
+	if interval := flushInterval(res, options); interval != 0 {
+		fw := newFlushWriter(d.res, interval)
+		defer fw.stop()
+
+		dst = fw
+	}
+
 	// Copy response body.
 	bb := bytebufferpool.Get()
-	n.copyBuffer(d.res, res.Body, bb.B)
-
-	defer res.Body.Close()
 	defer bytebufferpool.Put(bb)
 
-	if err != nil {
-		n.logger.Error(".doProxy copy response failed", zap.Int64("res.ContentLength", res.ContentLength), zap.Error(err))
-		return d.returnInternalServerError()
+	// The status is written already, the client gets a truncated body.
+	if _, err := n.copyBuffer(dst, res.Body, bb.B); err != nil {
+		n.logger.Error(".doProxy copy response failed", zap.String("upstream", res.Request.URL.Host), zap.Int64("res.ContentLength", res.ContentLength), zap.Error(err))
+		return d.done()
+	}
+
+	// Trailers which were not announced need the prefix.
+	for k, values := range res.Trailer {
+		if len(res.Trailer) != announced {
+			k = http.TrailerPrefix + k
+		}
+
+		for _, v := range values {
+			d.res.Header().Add(k, v)
+		}
 	}
 
 	return d.done()
 }
 
+// classifyProxyError returns the class of the error and the status the client
+// gets for it: 504 for timeouts, 502 for the others.
+func classifyProxyError(err error) (string, int) {
+	var opErr *net.OpError
+	var netErr net.Error
+	var tlsErr tls.RecordHeaderError
+	var certErr x509.CertificateInvalidError
+	var hostErr x509.HostnameError
+	var authErr x509.UnknownAuthorityError
+
+	switch {
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		if opErr.Timeout() {
+			return "timeout", http.StatusGatewayTimeout
+		}
+
+		return "connect", http.StatusBadGateway
+	case errors.Is(err, context.Canceled):
+		return "canceled", http.StatusBadGateway
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout", http.StatusGatewayTimeout
+	case errors.As(err, &tlsErr), errors.As(err, &certErr), errors.As(err, &hostErr), errors.As(err, &authErr):
+		return "tls", http.StatusBadGateway
+	}
+
+	return "protocol", http.StatusBadGateway
+}
+
+// logProxyError ...
+func (n *Nginless) logProxyError(caller string, e *proxyError) {
+	n.logger.Error(
+		caller+" upstream failed",
+		zap.String("upstream", e.Upstream),
+		zap.String("class", e.Class),
+		zap.Int("status", e.Status),
+		zap.Duration("elapsed", e.Elapsed),
+		zap.Error(e.Err),
+	)
+}
+
 func (n *Nginless) copyBuffer(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
 	if len(buf) == 0 {
 		buf = make([]byte, 32*1024)
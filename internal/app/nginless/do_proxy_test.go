@@ -0,0 +1,47 @@
+package nginless
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestUpstreamURI(t *testing.T) {
+	cases := []struct {
+		upstream string
+		request  string
+		prefix   string
+		uri      string
+	}{
+		{"http://svc", "/api/v1/users", "", "http://svc/api/v1/users"},
+		{"http://svc", "/api/v1/users", "/api/v1", "http://svc/users"},
+		{"http://svc", "/api/v1", "/api/v1", "http://svc/"},
+		{"http://svc", "/api/v10/users", "/api/v1", "http://svc/api/v10/users"},
+		{"http://svc", "/api/v1x", "/api/v1", "http://svc/api/v1x"},
+		{"http://svc", "/api/v1/users", "/api/v1/", "http://svc/users"},
+		{"http://svc", "/api/v1", "/api/v1/", "http://svc/api/v1"},
+		{"http://svc", "/other/api/v1", "/api/v1", "http://svc/other/api/v1"},
+		{"http://svc/internal", "/api/v1/users?id=1", "/api/v1", "http://svc/internal/users?id=1"},
+		{"http://svc/internal/", "/users", "", "http://svc/internal/users"},
+		{"http://svc/internal?key=k", "/api/v1/users?id=1", "/api/v1", "http://svc/internal/users?key=k&id=1"},
+		{"http://svc/internal?key=k", "/api/v1/users", "/api/v1", "http://svc/internal/users?key=k"},
+		{"http://svc", "/files/a%2Fb/c%20d", "/files", "http://svc/a%2Fb/c%20d"},
+		{"http://svc", "/files%2Fx/y", "/files", "http://svc/files%2Fx/y"},
+		{"http://svc/base%20dir", "/a%3Fb", "", "http://svc/base%20dir/a%3Fb"},
+	}
+
+	for _, c := range cases {
+		remote, err := url.Parse(c.upstream)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u, err := url.ParseRequestURI(c.request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if uri := upstreamURI(remote, u, c.prefix); uri != c.uri {
+			t.Errorf("upstreamURI(%s, %s, %q) = %s, want %s", c.upstream, c.request, c.prefix, uri, c.uri)
+		}
+	}
+}
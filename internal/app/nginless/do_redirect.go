@@ -0,0 +1,38 @@
+package nginless
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// doRedirect sends the client to the target.
+// eg:
+// redirect(301, https://www.testing.test/{{1}})
+func (n *Nginless) doRedirect(d *D, parameters []interface{}) *D {
+	if len(parameters) < 2 {
+		return d.returnInternalServerError()
+	}
+
+	code, err := redirectCode(paramString(parameters[0]))
+	if err != nil {
+		n.logger.Error(".doRedirect invalid code", zap.Error(err))
+		return d.returnInternalServerError()
+	}
+
+	http.Redirect(d.res, d.req, paramString(parameters[1]), code)
+
+	return d.done()
+}
+
+// redirectCode ...
+func redirectCode(s string) (int, error) {
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 300 || code > 399 {
+		return 0, fmt.Errorf("invalid redirect code %q", s)
+	}
+
+	return code, nil
+}
@@ -0,0 +1,74 @@
+package nginless
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/duanckham/nginless/internal/app/common/utils"
+	"go.uber.org/zap"
+)
+
+// doRespond writes a fixed response. The body is rendered with the variables
+// of the request, it's read from a file when the file option is set.
+// eg:
+// respond(410, text/plain, "{{path}} is gone")
+// respond(503, text/html, file=./pages/maintenance.html)
+func (n *Nginless) doRespond(d *D, parameters []interface{}, options StepOptions) *D {
+	if len(parameters) == 0 {
+		return d.returnInternalServerError()
+	}
+
+	status, err := statusCode(paramString(parameters[0]))
+	if err != nil {
+		n.logger.Error(".doRespond invalid status", zap.Error(err))
+		return d.returnInternalServerError()
+	}
+
+	contentType := "text/plain; charset=utf-8"
+	if len(parameters) > 1 {
+		contentType = paramString(parameters[1])
+	}
+
+	body := ""
+	if len(parameters) > 2 {
+		body = paramString(parameters[2])
+	}
+
+	if template := options.String("file", ""); template != "" {
+		file, ok := d.renderPath(template)
+		if !ok {
+			n.logger.Warn(".doRespond unsafe variable in file", zap.String("file", template), zap.String("path", d.req.URL.Path))
+			return d.returnNotFound()
+		}
+
+		bytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			n.logger.Error(".doRespond read file failed", zap.String("file", file), zap.Error(err))
+			return d.returnInternalServerError()
+		}
+
+		body = utils.Render(string(bytes), d.vars())
+	}
+
+	d.res.Header().Set("Content-Type", contentType)
+	d.res.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	d.res.WriteHeader(status)
+
+	if d.req.Method != http.MethodHead {
+		d.res.Write([]byte(body))
+	}
+
+	return d.done()
+}
+
+// statusCode ...
+func statusCode(s string) (int, error) {
+	code, err := strconv.Atoi(s)
+	if err != nil || code < 100 || code > 599 {
+		return 0, fmt.Errorf("invalid status code %q", s)
+	}
+
+	return code, nil
+}
@@ -0,0 +1,109 @@
+package nginless
+
+import (
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// maxRewritePatterns bounds the patterns cached, a pattern can be rendered
+// from the request.
+const maxRewritePatterns = 1024
+
+// rewritePatterns caches compiled rewrite patterns by source.
+var rewritePatterns = newLRU(maxRewritePatterns, nil)
+
+// doRewrite replaces the path of the request when the pattern matches it, the
+// replacement can use groups of the pattern as $1 or ${name}. A query in the
+// replacement replaces the query of the request.
+// eg:
+// rewrite(^/old/(.*), /new/$1)
+func (n *Nginless) doRewrite(d *D, parameters []interface{}) *D {
+	if len(parameters) < 2 {
+		return d.returnInternalServerError()
+	}
+
+	pattern, err := rewritePattern(paramString(parameters[0]))
+	if err != nil {
+		n.logger.Error(".doRewrite invalid pattern", zap.Error(err))
+		return d.returnInternalServerError()
+	}
+
+	groups, ok := pattern.match(d.req.URL.Path)
+	if !ok {
+		return d
+	}
+
+	s := expand(paramString(parameters[1]), groups)
+
+	if i := strings.Index(s, "?"); i >= 0 {
+		d.req.URL.RawQuery = s[i+1:]
+		s = s[:i]
+	}
+
+	d.req.URL.Path = s
+	d.req.URL.RawPath = ""
+
+	// Steps after this one, proxy included, see the new path.
+	d.req.RequestURI = d.req.URL.RequestURI()
+
+	return d
+}
+
+// rewritePattern ...
+func rewritePattern(source string) (*Pattern, error) {
+	if v, ok := rewritePatterns.load(source); ok {
+		return v.(*Pattern), nil
+	}
+
+	pattern, err := compilePattern(source)
+	if err != nil {
+		return nil, err
+	}
+
+	rewritePatterns.store(source, &pattern)
+
+	return &pattern, nil
+}
+
+// expand replaces $1 and ${name} in s with the groups, $$ is a literal $.
+func expand(s string, groups map[string]string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		switch c := s[i+1]; {
+		case c == '$':
+			b.WriteByte('$')
+			i++
+
+		case c == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				b.WriteByte(s[i])
+				continue
+			}
+
+			b.WriteString(groups[s[i+2:i+end]])
+			i += end
+
+		case c >= '0' && c <= '9':
+			j := i + 1
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+
+			b.WriteString(groups[s[i+1:j]])
+			i = j - 1
+
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,180 @@
+package nginless
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/duanckham/nginless/internal/app/common/utils"
+	"go.uber.org/zap"
+)
+
+// encodings are the precompressed siblings static looks for, by preference.
+var encodings = []struct {
+	name string
+	ext  string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// doStatic serves the file at the path of the request from root, a directory
+// is served by its first index file (index.html by default). When nothing is
+// found the fallback file of root is served, which is what single page apps
+// need.
+// eg:
+// static(./www/{{tenant}}, index.html, fallback=index.html, max_age=1h)
+func (n *Nginless) doStatic(d *D, parameters []interface{}, options StepOptions) *D {
+	if len(parameters) == 0 {
+		return d.returnInternalServerError()
+	}
+
+	if d.req.Method != http.MethodGet && d.req.Method != http.MethodHead {
+		d.res.Header().Set("Allow", "GET, HEAD")
+		d.res.WriteHeader(http.StatusMethodNotAllowed)
+		return d.done()
+	}
+
+	dir, ok := d.renderPath(paramString(parameters[0]))
+	if !ok {
+		n.logger.Warn(".doStatic unsafe variable in root", zap.String("root", paramString(parameters[0])), zap.String("path", d.req.URL.Path))
+		return d.returnNotFound()
+	}
+
+	// http.Dir keeps the path inside of root.
+	root := http.Dir(dir)
+
+	indexes := []string{"index.html"}
+	if len(parameters) > 1 {
+		indexes = []string{}
+
+		for _, v := range d.render(parameters[1:]) {
+			indexes = append(indexes, paramString(v))
+		}
+	}
+
+	name, info := findStatic(root, path.Clean("/"+d.req.URL.Path), indexes)
+
+	if info == nil {
+		if fallback := options.String("fallback", ""); fallback != "" {
+			name, info = findStatic(root, path.Clean("/"+fallback), nil)
+		}
+	}
+
+	if info == nil {
+		return d.returnNotFound()
+	}
+
+	if maxAge := options.Duration("max_age", 0); maxAge > 0 {
+		d.res.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(maxAge/time.Second)))
+	}
+
+	file, encoding := name, ""
+
+	if options.Bool("precompressed", true) {
+		d.res.Header().Add("Vary", "Accept-Encoding")
+
+		accepted := d.req.Header.Get("Accept-Encoding")
+
+		for _, e := range encodings {
+			if !strings.Contains(accepted, e.name) {
+				continue
+			}
+
+			if fi := statStatic(root, name+e.ext); fi != nil && fi.Mode().IsRegular() {
+				file, encoding, info = name+e.ext, e.name, fi
+				break
+			}
+		}
+	}
+
+	f, err := root.Open(file)
+	if err != nil {
+		n.logger.Error(".doStatic open file failed", zap.String("file", file), zap.Error(err))
+		return d.returnInternalServerError()
+	}
+
+	defer f.Close()
+
+	if encoding != "" {
+		d.res.Header().Set("Content-Encoding", encoding)
+	}
+
+	d.res.Header().Set("ETag", fmt.Sprintf(`W/"%x-%x"`, info.ModTime().Unix(), info.Size()))
+
+	// ServeContent handles Range and conditional requests, the content type
+	// comes from the name of the original file.
+	http.ServeContent(d.res, d.req, name, info.ModTime(), f)
+
+	return d.done()
+}
+
+// renderPath fills variables into a path of the config, eg: the root of
+// static or the file of respond. It reports false when one of the values used
+// could lead out of the directory the config meant: a value with a slash or
+// `..`, or an empty or unknown one.
+func (d *D) renderPath(template string) (string, bool) {
+	if !strings.Contains(template, "{{") {
+		return template, true
+	}
+
+	vars := d.vars()
+
+	for _, name := range utils.Names(template) {
+		v := vars[name]
+
+		if v == "" || v == "." || strings.Contains(v, "..") || strings.ContainsAny(v, "/\\") {
+			return "", false
+		}
+	}
+
+	return utils.Render(template, vars), true
+}
+
+// findStatic returns the file for name in root, directories are looked up for
+// one of the indexes.
+func findStatic(root http.FileSystem, name string, indexes []string) (string, os.FileInfo) {
+	info := statStatic(root, name)
+	if info == nil {
+		return "", nil
+	}
+
+	if info.Mode().IsRegular() {
+		return name, info
+	}
+
+	if !info.IsDir() {
+		return "", nil
+	}
+
+	for _, index := range indexes {
+		file := path.Join(name, filepath.ToSlash(index))
+
+		if info := statStatic(root, file); info != nil && info.Mode().IsRegular() {
+			return file, info
+		}
+	}
+
+	return "", nil
+}
+
+// statStatic ...
+func statStatic(root http.FileSystem, name string) os.FileInfo {
+	f, err := root.Open(name)
+	if err != nil {
+		return nil
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+
+	return info
+}
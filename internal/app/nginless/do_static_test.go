@@ -0,0 +1,44 @@
+package nginless
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRenderPath(t *testing.T) {
+	cases := []struct {
+		template string
+		params   map[string]string
+		path     string
+		ok       bool
+	}{
+		{"./www", nil, "./www", true},
+		{"./www/{{tenant}}", map[string]string{"tenant": "acme"}, "./www/acme", true},
+		{"./www/{{tenant}}/{{lang}}", map[string]string{"tenant": "acme", "lang": "en.v2"}, "./www/acme/en.v2", true},
+		{"./www/{{tenant}}", map[string]string{"tenant": "site-1_a"}, "./www/site-1_a", true},
+		{"./www/{{1}}.html", map[string]string{"1": "index"}, "./www/index.html", true},
+		{"./www/{{tenant}}", map[string]string{"tenant": ".."}, "", false},
+		{"./www/{{tenant}}", map[string]string{"tenant": "../etc"}, "", false},
+		{"./www/{{tenant}}", map[string]string{"tenant": "a/b"}, "", false},
+		{"./www/{{tenant}}", map[string]string{"tenant": "/etc"}, "", false},
+		{"./www/{{tenant}}", map[string]string{"tenant": `..\etc`}, "", false},
+		{"./www/{{tenant}}", map[string]string{"tenant": "a..b"}, "", false},
+		{"./www/{{tenant}}", map[string]string{"tenant": ""}, "", false},
+		{"./www/{{tenant}}", map[string]string{"tenant": "."}, "", false},
+		{"./www/{{tenant}}", map[string]string{"lang": "en"}, "", false},
+		{"./www/{{path}}", nil, "", false},
+		{"./www/{{.tenant}}", map[string]string{"tenant": "../etc"}, "", false},
+		{"./www/{{.tenant}}", map[string]string{"tenant": "acme"}, "./www/acme", true},
+		{"./www/{{host}}", nil, "./www/testing.test", true},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://testing.test/a/b", nil)
+		d := newD(req, httptest.NewRecorder(), &Server{}, c.params)
+
+		path, ok := d.renderPath(c.template)
+		if ok != c.ok || ok && path != c.path {
+			t.Errorf("renderPath(%q) with %v = %q, %v, want %q, %v", c.template, c.params, path, ok, c.path, c.ok)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package nginless
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/duanckham/nginless/internal/app/common/utils"
+)
+
+// ErrorPage is the page of the statuses from From to To. HTML and JSON are
+// template files, the one the client prefers is served.
+type ErrorPage struct {
+	From int
+	To   int
+	HTML string
+	JSON string
+}
+
+// parseErrorPages accepts the `error_pages` of a server, keyed by a status
+// (404), a range (500-599) or a class (5xx):
+//
+//   error_pages:
+//     404: ./pages/404.html
+//     5xx:
+//       html: ./pages/5xx.html
+//       json: ./pages/5xx.json
+func parseErrorPages(v interface{}) ([]ErrorPage, error) {
+	if v == nil {
+		return []ErrorPage{}, nil
+	}
+
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v should be a map of statuses to pages", v)
+	}
+
+	pages := []ErrorPage{}
+
+	for key, value := range m {
+		from, to, err := parseStatusRange(fmt.Sprint(key))
+		if err != nil {
+			return nil, err
+		}
+
+		page := ErrorPage{From: from, To: to}
+
+		switch t := value.(type) {
+		case string:
+			page.HTML = t
+		case map[interface{}]interface{}:
+			for k, file := range t {
+				s, ok := file.(string)
+				if !ok {
+					return nil, fmt.Errorf("error page %v: %v is not a file", key, file)
+				}
+
+				switch k {
+				case "html":
+					page.HTML = s
+				case "json":
+					page.JSON = s
+				default:
+					return nil, fmt.Errorf("error page %v: unknown type %q, expect html or json", key, k)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("error page %v should be a file or a map of html and json files", key)
+		}
+
+		if page.HTML == "" && page.JSON == "" {
+			return nil, fmt.Errorf("error page %v has no file", key)
+		}
+
+		pages = append(pages, page)
+	}
+
+	// The narrowest range wins.
+	sort.Slice(pages, func(i, j int) bool {
+		if pages[i].To-pages[i].From != pages[j].To-pages[j].From {
+			return pages[i].To-pages[i].From < pages[j].To-pages[j].From
+		}
+
+		return pages[i].From < pages[j].From
+	})
+
+	return pages, nil
+}
+
+// parseStatusRange ...
+func parseStatusRange(s string) (int, int, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if len(s) == 3 && strings.HasSuffix(s, "xx") && s[0] >= '1' && s[0] <= '5' {
+		from := int(s[0]-'0') * 100
+		return from, from + 99, nil
+	}
+
+	bounds := strings.SplitN(s, "-", 2)
+
+	from, err := statusCode(bounds[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	to := from
+
+	if len(bounds) == 2 {
+		to, err = statusCode(bounds[1])
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if to < from {
+			return 0, 0, fmt.Errorf("invalid status range %q", s)
+		}
+	}
+
+	return from, to, nil
+}
+
+// findErrorPage ...
+func findErrorPage(pages []ErrorPage, status int) *ErrorPage {
+	for i := range pages {
+		if status >= pages[i].From && status <= pages[i].To {
+			return &pages[i]
+		}
+	}
+
+	return nil
+}
+
+// negotiate returns the file of the page the client prefers with its content
+// type, falling back to the other one.
+func (p *ErrorPage) negotiate(req *http.Request) (string, string) {
+	accept := req.Header.Get("Accept")
+
+	json := strings.Index(accept, "json")
+	html := strings.Index(accept, "html")
+
+	if p.JSON != "" && (p.HTML == "" || json >= 0 && (html < 0 || json < html)) {
+		return p.JSON, "application/json"
+	}
+
+	return p.HTML, "text/html; charset=utf-8"
+}
+
+// writeErrorPage writes the page for the status, it reports false when there
+// is none or its file can't be read.
+func (d *D) writeErrorPage(status int) bool {
+	page := findErrorPage(d.server.ErrorPages, status)
+	if page == nil {
+		return false
+	}
+
+	file, contentType := page.negotiate(d.req)
+
+	bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+
+	vars := d.vars()
+	vars["status"] = strconv.Itoa(status)
+	vars["status_text"] = http.StatusText(status)
+
+	body := utils.Render(string(bytes), vars)
+
+	d.res.Header().Set("Content-Type", contentType)
+	d.res.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	d.res.Header().Del("Content-Encoding")
+	d.res.WriteHeader(status)
+
+	if d.req.Method != http.MethodHead {
+		d.res.Write([]byte(body))
+	}
+
+	return true
+}
@@ -0,0 +1,331 @@
+package nginless
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Actions taking the whole text between the brackets as their only parameter,
+// eg: json({"a":1, "b":2}).
+var singleParameterDoes = []string{"json"}
+
+// ParseError is a syntax error in a `do` expression.
+type ParseError struct {
+	Source string
+	Pos    int
+	Msg    string
+}
+
+// Error ...
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s at column %d of %q", e.Msg, e.Pos+1, e.Source)
+}
+
+// parseDoString parses a step expression:
+//
+//   step  = action "(" [ arg { "," arg } ] ")"
+//   arg   = [ option "=" ] value
+//   value = quoted | bare
+//
+// Quoted values use single or double quotes and support \" \' \\ \n \t
+// escapes. Bare values end at a comma or the closing bracket outside of
+// nested (), [], {} and double quotes, surrounding spaces are trimmed and
+// backslashes are kept as is, so regexes can be written without quotes. Only
+// the options the schema of the action declares are named, `a=1` is a
+// positional value of any other name. Values are kept as text, options are
+// converted to their types by validateStep.
+func parseDoString(s string) (Step, error) {
+	p := &exprParser{src: s}
+
+	p.skipSpaces()
+	action := p.ident()
+	if action == "" {
+		return Step{}, p.errorf("expect action name")
+	}
+
+	p.skipSpaces()
+	if !p.consume('(') {
+		return Step{}, p.errorf("expect `(` after %s", action)
+	}
+
+	step := Step{
+		Source:     s,
+		Action:     action,
+		Parameters: []interface{}{},
+		Options:    StepOptions{},
+	}
+
+	if isSingleParameter(action) {
+		end := strings.LastIndexByte(s, ')')
+		if end < p.pos {
+			return Step{}, p.errorf("expect `)`")
+		}
+
+		if body := strings.TrimSpace(s[p.pos:end]); body != "" {
+			step.Parameters = append(step.Parameters, body)
+		}
+
+		p.pos = end + 1
+	} else if err := p.args(&step, schemas[action].Options); err != nil {
+		return Step{}, err
+	}
+
+	p.skipSpaces()
+	if !p.eof() {
+		return Step{}, p.errorf("unexpected %q after `)`", p.src[p.pos])
+	}
+
+	return step, nil
+}
+
+func isSingleParameter(action string) bool {
+	for _, v := range singleParameterDoes {
+		if v == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+// exprParser ...
+type exprParser struct {
+	src string
+	pos int
+}
+
+func (p *exprParser) errorf(format string, a ...interface{}) error {
+	return &ParseError{p.src, p.pos, fmt.Sprintf(format, a...)}
+}
+
+func (p *exprParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *exprParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+
+	return p.src[p.pos]
+}
+
+func (p *exprParser) consume(c byte) bool {
+	if p.peek() == c && !p.eof() {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *exprParser) skipSpaces() {
+	for !p.eof() && (p.src[p.pos] == ' ' || p.src[p.pos] == '\t' || p.src[p.pos] == '\n' || p.src[p.pos] == '\r') {
+		p.pos++
+	}
+}
+
+// ident reads [A-Za-z_][A-Za-z0-9_]*.
+func (p *exprParser) ident() string {
+	start := p.pos
+
+	for !p.eof() {
+		c := p.src[p.pos]
+		if c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || p.pos > start && '0' <= c && c <= '9' {
+			p.pos++
+			continue
+		}
+
+		break
+	}
+
+	return p.src[start:p.pos]
+}
+
+// args reads arguments up to and including the closing bracket.
+func (p *exprParser) args(step *Step, options map[string]string) error {
+	p.skipSpaces()
+	if p.consume(')') {
+		return nil
+	}
+
+	for {
+		p.skipSpaces()
+
+		// Named argument, eg: timeout=5s.
+		name := ""
+		start := p.pos
+
+		if id := p.ident(); options[id] != "" {
+			p.skipSpaces()
+
+			if p.consume('=') {
+				name = id
+			} else {
+				p.pos = start
+			}
+		} else {
+			p.pos = start
+		}
+
+		p.skipSpaces()
+
+		value, err := p.value()
+		if err != nil {
+			return err
+		}
+
+		if name != "" {
+			if _, ok := step.Options[name]; ok {
+				return &ParseError{p.src, start, fmt.Sprintf("duplicate argument %s", name)}
+			}
+
+			step.Options[name] = value
+		} else {
+			if len(step.Options) > 0 {
+				return &ParseError{p.src, start, "positional argument after named argument"}
+			}
+
+			step.Parameters = append(step.Parameters, value)
+		}
+
+		p.skipSpaces()
+
+		switch {
+		case p.consume(','):
+			continue
+		case p.consume(')'):
+			return nil
+		case p.eof():
+			return p.errorf("expect `)`")
+		default:
+			return p.errorf("expect `,` or `)`")
+		}
+	}
+}
+
+// value ...
+func (p *exprParser) value() (string, error) {
+	switch p.peek() {
+	case '"', '\'':
+		return p.quoted()
+	}
+
+	start := p.pos
+	s, err := p.bare()
+	if err != nil {
+		return "", err
+	}
+
+	if s == "" {
+		return "", &ParseError{p.src, start, "empty argument"}
+	}
+
+	return s, nil
+}
+
+// quoted reads a quoted string and resolves escapes.
+func (p *exprParser) quoted() (string, error) {
+	start := p.pos
+	quote := p.src[p.pos]
+	p.pos++
+
+	var b strings.Builder
+
+	for !p.eof() {
+		c := p.src[p.pos]
+		p.pos++
+
+		switch c {
+		case quote:
+			return b.String(), nil
+
+		case '\\':
+			if p.eof() {
+				return "", &ParseError{p.src, start, "unterminated string"}
+			}
+
+			e := p.src[p.pos]
+			p.pos++
+
+			switch e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case '\\', '"', '\'':
+				b.WriteByte(e)
+			default:
+				// Keep unknown escapes, eg: \d in regexes.
+				b.WriteByte('\\')
+				b.WriteByte(e)
+			}
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return "", &ParseError{p.src, start, "unterminated string"}
+}
+
+// bare reads an unquoted value up to a comma or closing bracket at depth 0.
+func (p *exprParser) bare() (string, error) {
+	start := p.pos
+	stack := []byte{}
+
+	closing := map[byte]byte{'(': ')', '[': ']', '{': '}'}
+
+	for !p.eof() {
+		c := p.src[p.pos]
+
+		switch c {
+		case '\\':
+			// Keep escaped byte as is.
+			p.pos += 2
+			continue
+
+		case '"':
+			// Quotes inside bare values are kept, eg: {"a":1}. A quote without
+			// its closing one is a plain byte, single quotes always are, eg:
+			// ^/it's/.
+			quote := p.pos
+			if _, err := p.quoted(); err != nil {
+				p.pos = quote + 1
+			}
+
+			continue
+
+		case '(', '[', '{':
+			stack = append(stack, closing[c])
+
+		case ')', ']', '}':
+			if len(stack) == 0 {
+				if c == ')' {
+					return strings.TrimSpace(p.src[start:p.pos]), nil
+				}
+
+				return "", p.errorf("unexpected %q", c)
+			}
+
+			if stack[len(stack)-1] != c {
+				return "", p.errorf("expect %q, got %q", stack[len(stack)-1], c)
+			}
+
+			stack = stack[:len(stack)-1]
+
+		case ',':
+			if len(stack) == 0 {
+				return strings.TrimSpace(p.src[start:p.pos]), nil
+			}
+		}
+
+		p.pos++
+	}
+
+	if len(stack) > 0 {
+		return "", p.errorf("expect %q", stack[len(stack)-1])
+	}
+
+	return "", p.errorf("expect `)`")
+}
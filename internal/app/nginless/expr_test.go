@@ -0,0 +1,74 @@
+package nginless
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDoString(t *testing.T) {
+	cases := []struct {
+		do         string
+		parameters []interface{}
+		options    StepOptions
+	}{
+		{`proxy(https://www.google.com, https://www.twitter.com)`, []interface{}{"https://www.google.com", "https://www.twitter.com"}, StepOptions{}},
+		{`set_header(X-Id, 007)`, []interface{}{"X-Id", "007"}, StepOptions{}},
+		{`set_header(X-Version, 1.10)`, []interface{}{"X-Version", "1.10"}, StepOptions{}},
+		{`set_header(X-Debug, true)`, []interface{}{"X-Debug", "true"}, StepOptions{}},
+		{`add_response_header(Set-Cookie, seen=1)`, []interface{}{"Set-Cookie", "seen=1"}, StepOptions{}},
+		{`rewrite(^/it's/(.*), /its/$1)`, []interface{}{"^/it's/(.*)", "/its/$1"}, StepOptions{}},
+		{`rewrite(^/(a|b)/(\d+)$, /x/$2)`, []interface{}{`^/(a|b)/(\d+)$`, "/x/$2"}, StepOptions{}},
+		{`respond(200, text/plain, "a, b")`, []interface{}{"200", "text/plain", "a, b"}, StepOptions{}},
+		{`set_header(X-A, "a\"b\n")`, []interface{}{"X-A", "a\"b\n"}, StepOptions{}},
+		{`set_header(X-A, '\d+')`, []interface{}{"X-A", `\d+`}, StepOptions{}},
+		{`respond(200, application/json, {"a": [1, 2], "b": "x)"})`, []interface{}{"200", "application/json", `{"a": [1, 2], "b": "x)"}`}, StepOptions{}},
+		{`json({"success":true, "message":"hi"})`, []interface{}{`{"success":true, "message":"hi"}`}, StepOptions{}},
+		{`call(reverse_proxy)`, []interface{}{"reverse_proxy"}, StepOptions{}},
+		{`proxy(http://backend, timeout=5s, via=true)`, []interface{}{"http://backend"}, StepOptions{"timeout": 5 * time.Second, "via": true}},
+		{`proxy(http://backend, timeout = 5s, host="{{bucket}}.testing.test")`, []interface{}{"http://backend"}, StepOptions{"timeout": 5 * time.Second, "host": "{{bucket}}.testing.test"}},
+		{`balancing(http://a, http://b, weights="3, 1")`, []interface{}{"http://a", "http://b"}, StepOptions{"weights": []int64{3, 1}}},
+	}
+
+	for _, c := range cases {
+		steps, err := parseDo(c.do)
+		if err != nil {
+			t.Errorf("%s: %s", c.do, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(steps[0].Parameters, c.parameters) {
+			t.Errorf("%s: parameters %#v, want %#v", c.do, steps[0].Parameters, c.parameters)
+		}
+
+		if !reflect.DeepEqual(steps[0].Options, c.options) {
+			t.Errorf("%s: options %#v, want %#v", c.do, steps[0].Options, c.options)
+		}
+	}
+}
+
+func TestParseDoStringErrors(t *testing.T) {
+	cases := []struct {
+		do  string
+		err string
+	}{
+		{`proxy`, "expect `(` after proxy"},
+		{`proxy(http://a`, "expect `)`"},
+		{`proxy(http://a, timeout=5s, http://b)`, "positional argument after named argument"},
+		{`proxy(http://a, timeout=1s, timeout=2s)`, "duplicate argument timeout"},
+		{`proxy(http://a, {b)`, "expect '}'"},
+		{`set_header(X-A, "a)`, "unterminated string"},
+		{`proxy(http://a,)`, "empty argument"},
+		{`proxy(http://a) x`, "unexpected 'x' after `)`"},
+		{`proxy(http://a, timeout=soon)`, "expect a duration"},
+		{`balancing(http://a, weights=x)`, "expect an integer"},
+	}
+
+	for _, c := range cases {
+		_, err := parseDo(c.do)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got error %v, want %q", c.do, err, c.err)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package nginless
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// hopHeaders are meaningful for a single connection only, proxies must not
+// forward them. Headers listed in Connection are hop-by-hop as well.
+// refs:
+// https://datatracker.ietf.org/doc/html/rfc7230#section-6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders ...
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// setForwardedHeaders tells the upstream about the client with X-Forwarded-For,
+// X-Forwarded-Proto, X-Forwarded-Host and Forwarded. The headers sent by a
+// trusted proxy are appended to, the ones sent by anyone else are replaced.
+// refs:
+// https://datatracker.ietf.org/doc/html/rfc7239
+func setForwardedHeaders(h http.Header, req *http.Request, trusted []*net.IPNet) {
+	ip := remoteIP(req)
+	proto := requestScheme(req)
+	addresses := []string{}
+
+	if isTrusted(ip, trusted) {
+		addresses = forwardedFor(req)
+	} else {
+		h.Del("X-Forwarded-Proto")
+		h.Del("X-Forwarded-Host")
+		h.Del("Forwarded")
+	}
+
+	h.Set("X-Forwarded-For", strings.Join(append(addresses, ip), ", "))
+
+	if h.Get("X-Forwarded-Proto") == "" {
+		h.Set("X-Forwarded-Proto", proto)
+	}
+
+	if h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", req.Host)
+	}
+
+	element := fmt.Sprintf("for=%s;proto=%s", forwardedNode(ip), proto)
+	if req.Host != "" {
+		element += fmt.Sprintf(";host=%q", req.Host)
+	}
+
+	if forwarded := strings.Join(h.Values("Forwarded"), ", "); forwarded != "" {
+		element = forwarded + ", " + element
+	}
+
+	h.Set("Forwarded", element)
+}
+
+// forwardedNode quotes IPv6 addresses as Forwarded requires, eg: "[::1]".
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return fmt.Sprintf(`"[%s]"`, ip)
+	}
+
+	return ip
+}
+
+// addVia ...
+func addVia(h http.Header, protoMajor int, protoMinor int) {
+	h.Add("Via", fmt.Sprintf("%d.%d nginless", protoMajor, protoMinor))
+}
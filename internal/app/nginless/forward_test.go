@@ -0,0 +1,167 @@
+package nginless
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func trustedNetworks(t *testing.T, networks ...string) []*net.IPNet {
+	trusted := []*net.IPNet{}
+
+	for _, v := range networks {
+		network, err := parseNetwork(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		trusted = append(trusted, network)
+	}
+
+	return trusted
+}
+
+func TestClientIP(t *testing.T) {
+	trusted := trustedNetworks(t, "10.0.0.0/8", "127.0.0.1")
+
+	cases := []struct {
+		remote string
+		xff    []string
+		ip     string
+	}{
+		{"192.0.2.1:1234", nil, "192.0.2.1"},
+		{"192.0.2.1:1234", []string{"203.0.113.7"}, "192.0.2.1"},
+		{"127.0.0.1:1234", nil, "127.0.0.1"},
+		{"127.0.0.1:1234", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"127.0.0.1:1234", []string{"198.51.100.1, 203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"127.0.0.1:1234", []string{"198.51.100.1", "203.0.113.7, 10.0.0.2"}, "203.0.113.7"},
+		{"127.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"10.0.0.9:1234", []string{"not-an-ip, 10.0.0.2"}, "not-an-ip"},
+		{"[::1]:1234", []string{"203.0.113.7"}, "::1"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://testing.test/", nil)
+		req.RemoteAddr = c.remote
+
+		for _, v := range c.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+
+		if ip := clientIP(req, trusted); ip != c.ip {
+			t.Errorf("%s with %q: client ip %q, want %q", c.remote, c.xff, ip, c.ip)
+		}
+	}
+}
+
+func TestSetForwardedHeaders(t *testing.T) {
+	trusted := trustedNetworks(t, "10.0.0.0/8")
+
+	cases := []struct {
+		remote    string
+		tls       bool
+		in        map[string]string
+		xff       string
+		proto     string
+		host      string
+		forwarded string
+	}{
+		{
+			remote:    "192.0.2.1:1234",
+			xff:       "192.0.2.1",
+			proto:     "http",
+			host:      "testing.test",
+			forwarded: `for=192.0.2.1;proto=http;host="testing.test"`,
+		},
+		{
+			remote: "192.0.2.1:1234",
+			in: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "evil.test",
+				"Forwarded":         "for=203.0.113.7",
+			},
+			xff:       "192.0.2.1",
+			proto:     "http",
+			host:      "testing.test",
+			forwarded: `for=192.0.2.1;proto=http;host="testing.test"`,
+		},
+		{
+			remote: "10.0.0.2:1234",
+			tls:    true,
+			in: map[string]string{
+				"X-Forwarded-For":   "203.0.113.7, 10.0.0.5",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "www.testing.test",
+				"Forwarded":         "for=203.0.113.7",
+			},
+			xff:       "203.0.113.7, 10.0.0.5, 10.0.0.2",
+			proto:     "http",
+			host:      "www.testing.test",
+			forwarded: `for=203.0.113.7, for=10.0.0.2;proto=https;host="testing.test"`,
+		},
+		{
+			remote:    "[2001:db8::1]:1234",
+			xff:       "2001:db8::1",
+			proto:     "http",
+			host:      "testing.test",
+			forwarded: `for="[2001:db8::1]";proto=http;host="testing.test"`,
+		},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "http://testing.test/", nil)
+		req.RemoteAddr = c.remote
+
+		if c.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		for k, v := range c.in {
+			req.Header.Set(k, v)
+		}
+
+		h := req.Header.Clone()
+		setForwardedHeaders(h, req, trusted)
+
+		got := []string{h.Get("X-Forwarded-For"), h.Get("X-Forwarded-Proto"), h.Get("X-Forwarded-Host"), h.Get("Forwarded")}
+		want := []string{c.xff, c.proto, c.host, c.forwarded}
+
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s: got %q, want %q", c.remote, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestRemoveHopHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Add("Connection", "keep-alive, X-Hop")
+	h.Add("Connection", "x-other")
+	h.Set("X-Hop", "1")
+	h.Set("X-Other", "1")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Upgrade", "websocket")
+	h.Set("Proxy-Authorization", "Basic x")
+	h.Set("X-Kept", "1")
+	h.Set("Authorization", "Bearer x")
+
+	removeHopHeaders(h)
+
+	for _, name := range []string{"Connection", "X-Hop", "X-Other", "Keep-Alive", "Transfer-Encoding", "Upgrade", "Proxy-Authorization"} {
+		if _, ok := h[name]; ok {
+			t.Errorf("%s is kept", name)
+		}
+	}
+
+	for _, name := range []string{"X-Kept", "Authorization"} {
+		if h.Get(name) == "" {
+			t.Errorf("%s is removed", name)
+		}
+	}
+}
@@ -0,0 +1,457 @@
+package nginless
+
+import (
+	"regexp"
+	"sort"
+)
+
+// reInlineOption finds option settings such as (?i) or (?-i:, which change how
+// the literals after them match.
+var reInlineOption = regexp.MustCompile(`\(\?[a-zA-OQ-Z-]`)
+
+// index picks the handlers which may match a request, so Match doesn't have
+// to run every regex. A handler is indexed by a literal its condition
+// requires: the exact host, or a prefix of the url, path or host. Handlers
+// without such literal are always candidates. Candidates are tried in the
+// order of the rules, so the first match wins as with a plain scan.
+type index struct {
+	hosts    map[string][]int
+	prefixes map[string]*trie
+	fallback []int
+}
+
+// indexKey is a literal required by a condition.
+type indexKey struct {
+	target  string
+	literal string
+	exact   bool
+}
+
+// newIndex ...
+func newIndex(handlers []Handler) *index {
+	x := &index{
+		hosts: map[string][]int{},
+		prefixes: map[string]*trie{
+			"url":  newTrie(),
+			"path": newTrie(),
+			"host": newTrie(),
+		},
+		fallback: []int{},
+	}
+
+	for i, h := range handlers {
+		keys := requiredKeys(&h.Condition)
+		if len(keys) == 0 {
+			x.fallback = append(x.fallback, i)
+			continue
+		}
+
+		for _, k := range keys {
+			if k.exact {
+				x.hosts[k.literal] = appendOnce(x.hosts[k.literal], i)
+			} else {
+				x.prefixes[k.target].insert(k.literal, i)
+			}
+		}
+	}
+
+	return x
+}
+
+// candidates returns indexes of handlers which may match, in ascending order.
+func (x *index) candidates(sub *subject) []int {
+	c := []int{}
+
+	if len(x.hosts) > 0 {
+		c = append(c, x.hosts[sub.value(Target{"host", ""})]...)
+	}
+
+	for target, t := range x.prefixes {
+		if !t.empty() {
+			c = t.walk(sub.value(Target{target, ""}), c)
+		}
+	}
+
+	if len(c) == 0 {
+		return x.fallback
+	}
+
+	c = append(c, x.fallback...)
+	sort.Ints(c)
+
+	// Remove duplicates, a handler may be indexed by several keys.
+	j := 0
+	for i := range c {
+		if i == 0 || c[i] != c[j-1] {
+			c[j] = c[i]
+			j++
+		}
+	}
+
+	return c[:j]
+}
+
+// requiredKeys returns literals of which at least one is in any request
+// matching the node, or nil when there is no such set.
+func requiredKeys(node *Node) []indexKey {
+	switch node.Op {
+	case opTest:
+		if node.Target.B != "" || len(node.Regex) == 0 {
+			return nil
+		}
+
+		switch node.Target.A {
+		case "url", "path", "host":
+		default:
+			return nil
+		}
+
+		keys := []indexKey{}
+
+		for _, p := range node.Regex {
+			if !p.Anchored || p.Literal == "" {
+				return nil
+			}
+
+			keys = append(keys, indexKey{node.Target.A, p.Literal, p.Exact && node.Target.A == "host"})
+		}
+
+		return keys
+
+	case opAll:
+		for i := range node.Children {
+			if keys := requiredKeys(&node.Children[i]); len(keys) > 0 {
+				return keys
+			}
+		}
+
+	case opAny:
+		keys := []indexKey{}
+
+		for i := range node.Children {
+			k := requiredKeys(&node.Children[i])
+			if len(k) == 0 {
+				return nil
+			}
+
+			keys = append(keys, k...)
+		}
+
+		return keys
+	}
+
+	return nil
+}
+
+// extractLiteral returns the literal text a pattern starts with, whether the
+// pattern is anchored at the start, and whether it is nothing but the literal
+// anchored at both ends. Patterns with alternation have no literal.
+func extractLiteral(pattern string) (string, bool, bool) {
+	if containsUnescaped(pattern, '|') {
+		return "", false, false
+	}
+
+	anchored := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		anchored = true
+		pattern = pattern[1:]
+	}
+
+	literal := []byte{}
+	i := 0
+
+	for i < len(pattern) {
+		c := pattern[i]
+		next := i + 1
+
+		switch {
+		case c == '\\':
+			// Only escaped punctuation is literal, eg: \. or \/.
+			if i+1 >= len(pattern) || isWordByte(pattern[i+1]) {
+				return string(literal), anchored, false
+			}
+
+			c = pattern[i+1]
+			next = i + 2
+
+		case isMetaByte(c):
+			exact := anchored && c == '$' && i == len(pattern)-1
+			return string(literal), anchored, exact
+		}
+
+		// A quantifier makes the byte before it optional.
+		if next < len(pattern) {
+			switch pattern[next] {
+			case '?', '*', '{':
+				return string(literal), anchored, false
+			case '+':
+				return string(append(literal, c)), anchored, false
+			}
+		}
+
+		literal = append(literal, c)
+		i = next
+	}
+
+	return string(literal), anchored, false
+}
+
+// requiredLiteral returns the longest literal text outside of groups and
+// classes in a pattern without alternation or inline options, every match
+// contains it. Patterns with syntax it doesn't know have no literal.
+func requiredLiteral(pattern string) string {
+	if containsUnescaped(pattern, '|') || reInlineOption.MatchString(pattern) {
+		return ""
+	}
+
+	longest := ""
+	run := []byte{}
+
+	flush := func() {
+		if len(run) >= len(longest) {
+			longest = string(run)
+		}
+
+		run = run[:0]
+	}
+
+	for i := 0; i < len(pattern); {
+		c := pattern[i]
+		next := i + 1
+
+		switch {
+		case c == '\\':
+			if i+1 >= len(pattern) {
+				return ""
+			}
+
+			if isWordByte(pattern[i+1]) {
+				// Escapes like \x41 or \1 go on after the letter.
+				if !isClassEscape(pattern[i+1]) {
+					return ""
+				}
+
+				flush()
+				i += 2
+				continue
+			}
+
+			c = pattern[i+1]
+			next = i + 2
+
+		case c == '(' || c == '[':
+			flush()
+			i = skipGroup(pattern, i)
+			continue
+
+		case c == '{':
+			end, ok := skipQuantifier(pattern, i)
+			if !ok {
+				return ""
+			}
+
+			flush()
+			i = end
+			continue
+
+		case isMetaByte(c):
+			flush()
+			i = next
+			continue
+		}
+
+		if next < len(pattern) {
+			switch pattern[next] {
+			case '?', '*', '{':
+				flush()
+				i = next
+				continue
+			case '+':
+				run = append(run, c)
+				flush()
+				i = next
+				continue
+			}
+		}
+
+		run = append(run, c)
+		i = next
+	}
+
+	flush()
+
+	return longest
+}
+
+// skipQuantifier returns the position after the {n}, {n,} or {n,m}
+// quantifier starting at i, it reports false when the brace is no quantifier.
+func skipQuantifier(pattern string, i int) (int, bool) {
+	j := i + 1
+	digits := 0
+
+	for ; j < len(pattern) && '0' <= pattern[j] && pattern[j] <= '9'; j++ {
+		digits++
+	}
+
+	if digits == 0 {
+		return 0, false
+	}
+
+	if j < len(pattern) && pattern[j] == ',' {
+		j++
+
+		for j < len(pattern) && '0' <= pattern[j] && pattern[j] <= '9' {
+			j++
+		}
+	}
+
+	if j >= len(pattern) || pattern[j] != '}' {
+		return 0, false
+	}
+
+	return j + 1, true
+}
+
+// skipGroup returns the position after the group or class starting at i.
+func skipGroup(pattern string, i int) int {
+	if pattern[i] == '[' {
+		j := i + 1
+
+		// A leading ] or ^] is a literal ].
+		if j < len(pattern) && pattern[j] == '^' {
+			j++
+		}
+
+		if j < len(pattern) && pattern[j] == ']' {
+			j++
+		}
+
+		for ; j < len(pattern); j++ {
+			switch pattern[j] {
+			case '\\':
+				j++
+			case ']':
+				return j + 1
+			}
+		}
+
+		return len(pattern)
+	}
+
+	depth := 0
+
+	for j := i; j < len(pattern); j++ {
+		switch pattern[j] {
+		case '\\':
+			j++
+		case '[':
+			j = skipGroup(pattern, j) - 1
+		case '(':
+			depth++
+		case ')':
+			depth--
+
+			if depth == 0 {
+				return j + 1
+			}
+		}
+	}
+
+	return len(pattern)
+}
+
+func containsUnescaped(pattern string, b byte) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case b:
+			return true
+		}
+	}
+
+	return false
+}
+
+func isMetaByte(c byte) bool {
+	switch c {
+	case '.', '+', '*', '?', '(', ')', '[', ']', '{', '}', '^', '$', '|':
+		return true
+	}
+
+	return false
+}
+
+// isClassEscape reports whether \c is a complete escape, such as \d or \b.
+func isClassEscape(c byte) bool {
+	switch c {
+	case 'd', 'D', 'w', 'W', 's', 'S', 'h', 'H', 'v', 'V', 'R', 'b', 'B', 'A', 'z', 'Z', 'G', 'K', 'X', 'C', 't', 'n', 'r', 'f', 'e', 'a':
+		return true
+	}
+
+	return false
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func appendOnce(s []int, i int) []int {
+	if len(s) > 0 && s[len(s)-1] == i {
+		return s
+	}
+
+	return append(s, i)
+}
+
+// trie maps literal prefixes to handlers.
+type trie struct {
+	root *trieNode
+}
+
+type trieNode struct {
+	children map[byte]*trieNode
+	handlers []int
+}
+
+func newTrie() *trie {
+	return &trie{&trieNode{children: map[byte]*trieNode{}}}
+}
+
+func (t *trie) empty() bool {
+	return len(t.root.children) == 0
+}
+
+// insert ...
+func (t *trie) insert(prefix string, handler int) {
+	node := t.root
+
+	for i := 0; i < len(prefix); i++ {
+		child, ok := node.children[prefix[i]]
+		if !ok {
+			child = &trieNode{children: map[byte]*trieNode{}}
+			node.children[prefix[i]] = child
+		}
+
+		node = child
+	}
+
+	node.handlers = appendOnce(node.handlers, handler)
+}
+
+// walk appends handlers of every prefix of s to c.
+func (t *trie) walk(s string, c []int) []int {
+	node := t.root
+
+	for i := 0; i < len(s); i++ {
+		child, ok := node.children[s[i]]
+		if !ok {
+			break
+		}
+
+		node = child
+		c = append(c, node.handlers...)
+	}
+
+	return c
+}
@@ -0,0 +1,145 @@
+package nginless
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRequiredLiteral(t *testing.T) {
+	cases := []struct {
+		pattern string
+		literal string
+	}{
+		{`testing.test:.*/api`, "testing"},
+		{`^/v\d{1,3}/`, "/v"},
+		{`x{2,}`, ""},
+		{`^/users/\d{2}/profile`, "/profile"},
+		{`(ab){2}cd`, "cd"},
+		{`^/a\.b/c`, "/a.b/c"},
+		{`^/brace/\{x\}`, "/brace/{x}"},
+		{`ab{x}`, ""},
+		{`^/files/\x41bc`, ""},
+		{`^/one|^/two`, ""},
+		{`(?i)^/admin`, ""},
+	}
+
+	for _, c := range cases {
+		if literal := requiredLiteral(c.pattern); literal != c.literal {
+			t.Errorf("requiredLiteral(%q) = %q, want %q", c.pattern, literal, c.literal)
+		}
+	}
+}
+
+// TestMatchAgreesWithScan checks the index and the literal filters against a
+// plain scan of the regexes, the first matching rule must be the same.
+func TestMatchAgreesWithScan(t *testing.T) {
+	rules := []Rule{
+		{Clause: Clause{Condition: `^/v\d{1,3}/`, Test: "path"}},
+		{Clause: Clause{Condition: `x{2,}`, Test: "path"}},
+		{Clause: Clause{Condition: `^/(foo|bar)/baz`, Test: "path"}},
+		{Clause: Clause{Condition: `^/one|^/two`, Test: "path"}},
+		{Clause: Clause{Condition: `(?i)^/admin`, Test: "path"}},
+		{Clause: Clause{Condition: `^/x(?i)abc`, Test: "path"}},
+		{Clause: Clause{Condition: `^/files/\x41bc`, Test: "path"}},
+		{Clause: Clause{Condition: `\d+\.json$`, Test: "path"}},
+		{Clause: Clause{Condition: `^/lit\.dot/`, Test: "path"}},
+		{Clause: Clause{Any: []Clause{
+			{Condition: `^/any/a`, Test: "path"},
+			{Condition: `^beta\.testing\.test$`, Test: "host"},
+		}}},
+		{Clause: Clause{All: []Clause{
+			{Condition: `^/all/`, Test: "path"},
+			{Not: &Clause{Condition: `^1$`, Test: "header.x-opt-out"}},
+		}}},
+		{Clause: Clause{Condition: `^/w\d{1,2}/(.*)`, Test: "path"}},
+		{Clause: Clause{Condition: `a{2}b{1}c`}},
+		{Clause: Clause{Condition: `^/brace/\{x\}`, Test: "path"}},
+		{Clause: Clause{Condition: `^/q/[a-z]{3}$`, Test: "path"}},
+		{Clause: Clause{Condition: `^api\.testing\.test$`, Test: "host"}},
+		{Clause: Clause{Condition: `/catch/`}},
+	}
+
+	for i := range rules {
+		rules[i].Do = DoConfig{"json({})"}
+	}
+
+	cases := []struct {
+		url     string
+		headers map[string]string
+		rule    int
+	}{
+		{"http://testing.test/v12/", nil, 0},
+		{"http://testing.test/v1234/", nil, -1},
+		{"http://testing.test/axx", nil, 1},
+		{"http://testing.test/ax", nil, -1},
+		{"http://testing.test/bar/baz", nil, 2},
+		{"http://testing.test/two", nil, 3},
+		{"http://testing.test/ADMIN", nil, 4},
+		{"http://testing.test/xABC", nil, 5},
+		{"http://testing.test/files/Abc", nil, 6},
+		{"http://testing.test/data/12.json", nil, 7},
+		{"http://testing.test/lit.dot/", nil, 8},
+		{"http://testing.test/litxdot/", nil, -1},
+		{"http://beta.testing.test/", nil, 9},
+		{"http://testing.test/any/a", nil, 9},
+		{"http://testing.test/all/", nil, 10},
+		{"http://testing.test/all/", map[string]string{"X-Opt-Out": "1"}, -1},
+		{"http://testing.test/w12/rest", nil, 11},
+		{"http://testing.test/aabc", nil, 12},
+		{"http://testing.test/brace/{x}", nil, 13},
+		{"http://testing.test/q/abc", nil, 14},
+		{"http://testing.test/q/abcd", nil, -1},
+		{"http://api.testing.test/none", nil, 15},
+		{"http://testing.test/catch/me", nil, 16},
+	}
+
+	s, errs := newServer("", ServerConfig{Rules: rules})
+	if len(errs) > 0 {
+		t.Fatal(ConfigErrors(errs))
+	}
+
+	// The same rules with the literal filters off, scan then runs every regex.
+	plain, _ := newServer("", ServerConfig{Rules: rules})
+	for i := range plain.Handlers {
+		removeFilters(&plain.Handlers[i].Condition)
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.url, nil)
+		for k, v := range c.headers {
+			req.Header.Set(k, v)
+		}
+
+		matched, handler, params := s.Match(req)
+		wantMatched, want, wantParams := plain.scan(req)
+
+		rule, wantRule := -1, -1
+		if matched {
+			rule = handler.Index
+		}
+
+		if wantMatched {
+			wantRule = want.Index
+		}
+
+		if wantRule != c.rule {
+			t.Errorf("%s: scan matched rule %d, the case expects %d", c.url, wantRule, c.rule)
+		}
+
+		if rule != wantRule || !reflect.DeepEqual(params, wantParams) {
+			t.Errorf("%s: Match got rule %d %v, scan got rule %d %v", c.url, rule, params, wantRule, wantParams)
+		}
+	}
+}
+
+func removeFilters(node *Node) {
+	for i := range node.Regex {
+		node.Regex[i].Anchored = false
+		node.Regex[i].Required = ""
+	}
+
+	for i := range node.Children {
+		removeFilters(&node.Children[i])
+	}
+}
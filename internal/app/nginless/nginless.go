@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/duanckham/nginless/internal/app/common/https"
@@ -15,11 +16,13 @@ import (
 
 // Nginless ...
 type Nginless struct {
-	version string
-	ports   []string
-	logger  *zap.Logger
-	router  *Router
-	actions string
+	version    string
+	ports      []string
+	logger     *zap.Logger
+	router     atomic.Value
+	routerPath string
+	actions    string
+	tls        https.Listener
 }
 
 // Options ...
@@ -43,13 +46,20 @@ func New(options Options) *Nginless {
 	fmt.Printf("* action path: %s\n", *actionPath)
 	fmt.Printf("*       ports: %s\n", *ports)
 
-	return &Nginless{
-		version: options.Version,
-		ports:   strings.Split(*ports, ","),
-		logger:  options.Logger,
-		router:  router,
-		actions: *actionPath,
+	n := &Nginless{
+		version:    options.Version,
+		ports:      strings.Split(*ports, ","),
+		logger:     options.Logger,
+		routerPath: *routerPath,
+		actions:    *actionPath,
+		tls:        https.New(),
 	}
+
+	if err := n.setRouter(router); err != nil {
+		panic(err.Error())
+	}
+
+	return n
 }
 
 // Run ...
@@ -74,6 +84,9 @@ func (n *Nginless) Run() {
 	httpListener := m.Match(cmux.HTTP1Fast())
 	httpsListener := m.Match(cmux.Any())
 
+	// Reload router when the config file changes.
+	go n.watchRouter()
+
 	// Start HTTP service.
 	go n.startHTTP(httpListener)
 	// Start HTTPS service.
@@ -88,55 +101,86 @@ func (n *Nginless) startHTTP(l net.Listener) {
 }
 
 func (n *Nginless) startHTTPS(l net.Listener) {
-	// Pick certificate pairs from all rules.
-	pairs := make([][2]string, len(n.router.Certificates))
+	// Bind original listener, certificates of the router are loaded into it
+	// whenever the router is set.
+	n.tls.Bind(l)
+
+	http.Serve(n.tls, nil)
+}
 
-	for i, v := range n.router.Certificates {
+// certificatePairs picks certificate pairs from all servers of the router.
+func certificatePairs(router *Router) [][2]string {
+	certificates := router.AllCertificates()
+	pairs := make([][2]string, len(certificates))
+
+	for i, v := range certificates {
 		if v.Certificate != "" && v.Key != "" {
 			pairs[i] = [2]string{v.Certificate, v.Key}
 		}
 	}
 
-	// Create HTTPS listener.
-	listener := https.New()
-
-	// Bind original listener.
-	listener.Bind(l)
-
-	// Load all certificate pairs.
-	listener.LoadPairs(pairs)
-
-	http.Serve(listener, nil)
+	return pairs
 }
 
 func (n *Nginless) handleTraffic(w http.ResponseWriter, req *http.Request) {
-	matched, handler := n.router.Match(req)
+	// Hold on to the current router, a reload won't affect this request.
+	router := n.getRouter()
+	server := router.Select(req)
+	matched, handler, params := server.Match(req)
 
 	// Write nginless sign into header.
 	w.Header().Del("x-nginless-version")
 	w.Header().Set("x-nginless-version", n.version)
 
-	d := &D{req, w, false}
+	d := newD(req, w, server, params)
 
 	if !matched {
-		d.returnInternalServerError()
+		n.logger.Info(
+			".handleTraffic no rule matched",
+			zap.String("server", server.Name),
+			zap.String("host", req.Host),
+			zap.String("path", req.URL.Path),
+		)
+
+		switch {
+		case len(server.Default) > 0:
+			n.runSteps(d, server.Default)
+		case len(router.Default) > 0:
+			n.runSteps(d, router.Default)
+		default:
+			d.returnNotFound()
+		}
+
 		return
 	}
 
-	// Run steps.
-	for i, step := range handler.Steps {
+	n.runSteps(d, handler.Steps)
+}
+
+// runSteps runs steps in order until one of them finishes the response, it is
+// an error when none does.
+func (n *Nginless) runSteps(d *D, steps []Step) {
+	for i, step := range steps {
 		start := time.Now()
+		uri := d.req.URL.String()
+
+		d = n.do(d, step)
 
 		n.logger.Info(
 			".handleTraffic",
 			zap.Int("step", i),
-			zap.String("uri", req.URL.String()),
+			zap.String("uri", uri),
 			zap.String("rule", step.Source),
 			zap.String("action", step.Action),
 			zap.Any("parameters", step.Parameters),
 			zap.Duration("took", time.Since(start)),
 		)
 
-		d = n.do(d, step)
+		if d.finished {
+			return
+		}
 	}
+
+	n.logger.Error(".handleTraffic no step finished the response", zap.String("uri", d.req.URL.String()))
+	d.returnInternalServerError()
 }
@@ -0,0 +1,112 @@
+package nginless
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// reloadDelay collects the burst of events editors produce on a single save.
+const reloadDelay = 200 * time.Millisecond
+
+// getRouter returns the router currently in use.
+func (n *Nginless) getRouter() *Router {
+	return n.router.Load().(*Router)
+}
+
+// setRouter swaps the router in along with its certificates and upstream
+// configs, nothing is swapped when the certificates fail to load.
+func (n *Nginless) setRouter(router *Router) error {
+	if err := n.tls.ReloadPairs(certificatePairs(router)); err != nil {
+		return err
+	}
+
+	upstreamTransports.configure(router.Upstreams)
+	n.router.Store(router)
+
+	return nil
+}
+
+// reloadRouter parses the router config file again and swaps it in, the
+// current router is kept when the new one is invalid.
+func (n *Nginless) reloadRouter() {
+	router, err := LoadRouter(n.routerPath)
+	if err != nil {
+		n.logger.Error(".reloadRouter failed, keep the current router", zap.String("path", n.routerPath), zap.Error(err))
+		return
+	}
+
+	if err := n.setRouter(router); err != nil {
+		n.logger.Error(".reloadRouter load certificates failed, keep the current router", zap.String("path", n.routerPath), zap.Error(err))
+		return
+	}
+
+	n.logger.Info(".reloadRouter", zap.String("path", n.routerPath), zap.Int("rules", len(router.Rules)), zap.Int("servers", len(router.Servers)+len(router.wildcards)))
+}
+
+// watchRouter reloads the router on SIGHUP or when the config file changes.
+func (n *Nginless) watchRouter() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	// Watch the directory rather than the file, editors usually replace the
+	// file on save and the watch on the old inode would be lost.
+	var events chan fsnotify.Event
+	var errs chan error
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		n.logger.Error(".watchRouter create watcher failed", zap.Error(err))
+	} else {
+		defer watcher.Close()
+
+		err = watcher.Add(filepath.Dir(n.routerPath))
+		if err != nil {
+			n.logger.Error(".watchRouter watch router path failed", zap.String("path", n.routerPath), zap.Error(err))
+		} else {
+			events = watcher.Events
+			errs = watcher.Errors
+		}
+	}
+
+	target := filepath.Clean(n.routerPath)
+
+	var timer *time.Timer
+	var fire <-chan time.Time
+
+	for {
+		select {
+		case <-hup:
+			n.reloadRouter()
+
+		case event := <-events:
+			if filepath.Clean(event.Name) != target {
+				continue
+			}
+
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+
+			if timer == nil {
+				timer = time.NewTimer(reloadDelay)
+			} else {
+				timer.Reset(reloadDelay)
+			}
+
+			fire = timer.C
+
+		case <-fire:
+			fire = nil
+			n.reloadRouter()
+
+		case err := <-errs:
+			n.logger.Error(".watchRouter got error", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package nginless
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// requestHost returns the host of the request without port.
+func requestHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		return req.Host
+	}
+
+	return host
+}
+
+// requestScheme returns https for requests came from the HTTPS listener.
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+
+	return "http"
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only read
+// when the peer is a trusted proxy, the last address in it which is not a
+// trusted proxy is the client.
+func clientIP(req *http.Request, trusted []*net.IPNet) string {
+	ip := remoteIP(req)
+
+	if !isTrusted(ip, trusted) {
+		return ip
+	}
+
+	forwarded := forwardedFor(req)
+
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = forwarded[i]
+
+		if !isTrusted(ip, trusted) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// forwardedFor returns the addresses in X-Forwarded-For, in order.
+func forwardedFor(req *http.Request) []string {
+	addresses := []string{}
+
+	for _, v := range req.Header.Values("X-Forwarded-For") {
+		for _, address := range strings.Split(v, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+	}
+
+	return addresses
+}
+
+// isTrusted reports whether ip is in one of the trusted networks.
+func isTrusted(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, network := range trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// remoteIP returns the address of the peer.
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
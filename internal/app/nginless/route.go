@@ -0,0 +1,209 @@
+package nginless
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/duanckham/nginless/internal/app/common/utils"
+)
+
+// headerFlags collects repeated -H flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	*h = append(*h, v)
+	return nil
+}
+
+// Route runs a request through the router without sending it anywhere, and
+// prints the rule it hits, the steps and captures, and the rules before it
+// which nearly matched. It returns the exit code.
+//
+// nginless route -r ${router_yaml_file} [-X POST] [-H "Name: value"] [-ip 10.0.0.1] ${url}
+func Route(args []string) int {
+	fs := flag.NewFlagSet("route", flag.ExitOnError)
+	routerPath := fs.String("r", "", "Router config file path")
+	method := fs.String("X", "GET", "Request method")
+	ip := fs.String("ip", "192.0.2.1", "Client address")
+	headers := headerFlags{}
+	fs.Var(&headers, "H", "Request header, eg: \"User-Agent: curl\", repeatable")
+
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fmt.Println("usage: nginless route -r ${router_yaml_file} [-X method] [-H header]... [-ip address] ${url}")
+		return 2
+	}
+
+	router, err := LoadRouter(*routerPath)
+	if err != nil {
+		fmt.Printf("%s: %s\n", *routerPath, err)
+		return 1
+	}
+
+	req, err := http.NewRequest(strings.ToUpper(*method), fs.Arg(0), nil)
+	if err != nil {
+		fmt.Printf("invalid url %q: %s\n", fs.Arg(0), err)
+		return 2
+	}
+
+	req.RemoteAddr = net.JoinHostPort(*ip, "0")
+
+	// The scheme of the url tells whether the request came over TLS.
+	if req.URL.Scheme == "https" {
+		req.TLS = &tls.ConnectionState{ServerName: req.URL.Hostname()}
+	}
+
+	// The server sees the URI as sent in the request line, without scheme and
+	// host.
+	req.URL.Scheme = ""
+	req.URL.Host = ""
+	req.RequestURI = req.URL.RequestURI()
+
+	for _, h := range headers {
+		kv := strings.SplitN(h, ":", 2)
+		if len(kv) != 2 {
+			fmt.Printf("invalid header %q, expect \"Name: value\"\n", h)
+			return 2
+		}
+
+		value := strings.TrimSpace(kv[1])
+
+		if strings.EqualFold(kv[0], "host") {
+			req.Host = value
+		} else {
+			req.Header.Add(strings.TrimSpace(kv[0]), value)
+		}
+	}
+
+	server := router.Select(req)
+	matched, handler, params := server.Match(req)
+
+	if server.Name == "" {
+		fmt.Printf("server: (top-level)\n")
+	} else {
+		fmt.Printf("server: %s\n", server.Name)
+	}
+
+	// Rules before the matched one which passed some of their checks.
+	sub := newSubject(req, server.trusted)
+
+	for i := range server.Handlers {
+		h := &server.Handlers[i]
+
+		if matched && h.Index == handler.Index {
+			break
+		}
+
+		methodOK := h.matchMethod(req.Method)
+		lines := []string{}
+		passed := h.Condition.trace(sub, "    ", &lines)
+
+		if !methodOK && passed || methodOK && hasPassedTest(lines) {
+			fmt.Printf("near miss: rule %d\n", h.Index)
+
+			if !methodOK {
+				fmt.Printf("    [--] method %s not in %s\n", req.Method, strings.Join(h.Methods, ", "))
+			}
+
+			for _, l := range lines {
+				fmt.Println(l)
+			}
+		}
+	}
+
+	if !matched {
+		steps := server.Default
+		if len(steps) == 0 {
+			steps = router.Default
+		}
+
+		fmt.Printf("matched: none\n")
+
+		if len(steps) == 0 {
+			fmt.Printf("steps: (404 Not Found)\n")
+		} else {
+			printSteps(steps, newD(req, nil, server, nil).vars())
+		}
+
+		return 0
+	}
+
+	fmt.Printf("matched: rule %d\n", handler.Index)
+
+	lines := []string{}
+	handler.Condition.trace(sub, "    ", &lines)
+
+	for _, l := range lines {
+		fmt.Println(l)
+	}
+
+	keys := []string{}
+	for k := range params {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	fmt.Printf("captures:\n")
+
+	for _, k := range keys {
+		fmt.Printf("    %s = %q\n", k, params[k])
+	}
+
+	// The same variables the steps get, the response is never written.
+	printSteps(handler.Steps, newD(req, nil, server, params).vars())
+
+	return 0
+}
+
+// printSteps ...
+func printSteps(steps []Step, vars map[string]string) {
+	fmt.Printf("steps:\n")
+
+	for i, step := range steps {
+		fmt.Printf("    %d. %s\n", i, step.Source)
+		fmt.Printf("       action: %s\n", step.Action)
+
+		for j, p := range step.Parameters {
+			s := fmt.Sprintf("%v", p)
+			rendered := utils.Render(s, vars)
+
+			if rendered != s {
+				fmt.Printf("       parameter %d: %q -> %q\n", j, s, rendered)
+			} else {
+				fmt.Printf("       parameter %d: %q\n", j, s)
+			}
+		}
+
+		names := []string{}
+		for k := range step.Options {
+			names = append(names, k)
+		}
+
+		sort.Strings(names)
+
+		for _, k := range names {
+			fmt.Printf("       %s = %#v\n", k, step.Options[k])
+		}
+	}
+}
+
+func hasPassedTest(lines []string) bool {
+	for _, l := range lines {
+		if strings.Contains(l, "[ok] ") && !strings.HasSuffix(l, " (no condition)") {
+			return true
+		}
+	}
+
+	return false
+}
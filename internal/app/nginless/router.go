@@ -1,27 +1,17 @@
 package nginless
 
 import (
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"reflect"
-	"regexp"
+	"sort"
 	"strings"
 
-	"github.com/duanckham/go-pcre"
 	"gopkg.in/yaml.v2"
 )
 
-var (
-	lb    = "("[0]
-	rb    = ")"[0]
-	comma = ","[0]
-	space = " "[0]
-)
-
-var singleParameterDoes = []string{"json"}
-
-var reHeaderTest = regexp.MustCompile(`^header\.`)
-
 // Config is the config yaml file structure.
 //
 // <example: something.yaml>
@@ -38,23 +28,73 @@ var reHeaderTest = regexp.MustCompile(`^header\.`)
 //   - rule: testing.test:.*/proxy
 //     do: proxy(https://www.google.com, https://www.twitter.com)
 //
+//   - rule: testing.test:.*/api
+//     method: [POST, PUT, DELETE]
+//     do: proxy(https://writer.testing.test)
+//
 //   - rule: AppleWebKit\/\d+\.\d+\s
 //     test: header.user-agent
 //     do: json({"success":true,"message":"matching header.user-agent"})
 //
+//   - all:
+//       - rule: testing.test:.*/beta
+//       - test: header.x-canary
+//       - not:
+//           rule: ^1$
+//           test: header.x-opt-out
+//     do: proxy(https://canary.testing.test)
+//
+//   - rule: testing.test:.*/status
+//     do:
+//       - json:
+//           body: {success: true}
+//
+// default: json({"success":false,"message":"not found"})
+//
+// error_pages:
+//   404: ./examples/404.html
+//   5xx:
+//     html: ./examples/5xx.html
+//     json: ./examples/5xx.json
+//
 // certificates:
 //   - certificate: ./examples/testing.test.crt
 //     key: ./examples/testing.test.key
+//
+// servers:
+//   api.testing.test:
+//     rules:
+//       - rule: ^/v1/
+//         test: path
+//         do: proxy(https://v1.testing.test)
+//     default: json({"success":false,"message":"unknown api"})
+//
+//   "*.testing.test":
+//     rules:
+//       - do: proxy(https://www.testing.test)
+//
+// upstreams:
+//   https://www.testing.test:
+//     max_conns: 256
+//     dial_timeout: 5s
+//
+// trusted_proxies: [10.0.0.0/8]
 type Config struct {
-	Rules        []Rule        `yaml:"rules"`
-	Certificates []Certificate `yaml:"certificates"`
+	ServerConfig   `yaml:",inline"`
+	Servers        map[string]ServerConfig   `yaml:"servers"`
+	Upstreams      map[string]UpstreamConfig `yaml:"upstreams"`
+	TrustedProxies []string                  `yaml:"trusted_proxies"`
 }
 
 // Router ...
 type Router struct {
-	Rules        []Rule
-	Certificates []Certificate
-	Handlers     []Handler
+	// Server holds the top-level rules, used when no server matches the host.
+	Server
+	Servers   map[string]*Server
+	Upstreams map[string]UpstreamConfig
+	// TrustedProxies are the peers whose forwarded headers are kept.
+	TrustedProxies []*net.IPNet
+	wildcards      []*Server
 }
 
 // Certificate ...
@@ -65,189 +105,339 @@ type Certificate struct {
 
 // Rule ...
 type Rule struct {
-	Condition interface{} `yaml:"rule"`
-	Test      string      `yaml:"test"`
-	Do        interface{} `yaml:"do"`
+	Clause `yaml:",inline"`
+	Method interface{} `yaml:"method"`
+	Do     DoConfig    `yaml:"do"`
+}
+
+// DoConfig is the `do` of a rule or a `default` in the router config file.
+// Scalars keep the text they are written with along with the value yaml
+// reads, so the map form of a step gets 007 as the expression form does,
+// not 7.
+type DoConfig struct {
+	Value interface{}
 }
 
-// Target $A.$B, eg: header.user-agent.
-type Target struct {
-	A string
-	B string
+// UnmarshalYAML ...
+func (c *DoConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v interface{}
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch v.(type) {
+	case nil:
+		c.Value = nil
+
+	case []interface{}:
+		items := []DoConfig{}
+		if err := unmarshal(&items); err != nil {
+			return err
+		}
+
+		list := make([]interface{}, len(items))
+		for i, item := range items {
+			list[i] = item.Value
+		}
+
+		c.Value = list
+
+	case map[interface{}]interface{}:
+		items := map[interface{}]DoConfig{}
+		if err := unmarshal(&items); err != nil {
+			return err
+		}
+
+		m := map[interface{}]interface{}{}
+		for k, item := range items {
+			m[k] = item.Value
+		}
+
+		c.Value = m
+
+	default:
+		// yaml gives the text of any scalar to a string.
+		text := ""
+		if err := unmarshal(&text); err != nil {
+			return err
+		}
+
+		c.Value = yamlScalar{text, v}
+	}
+
+	return nil
 }
 
-// Handler ...
+// ConfigError is a problem in the router config file, Rule is -1 for problems
+// outside of rules.
+type ConfigError struct {
+	Server string
+	Rule   int
+	Err    error
+}
+
+// Error ...
+func (e *ConfigError) Error() string {
+	s := ""
+
+	if e.Server != "" {
+		s += fmt.Sprintf("server %s: ", e.Server)
+	}
+
+	if e.Rule >= 0 {
+		s += fmt.Sprintf("rule %d: ", e.Rule)
+	}
+
+	return s + e.Err.Error()
+}
+
+// ConfigErrors is every problem found in the router config file, ordered by
+// server and rule.
+type ConfigErrors []*ConfigError
+
+// Error ...
+func (e ConfigErrors) Error() string {
+	s := make([]string, len(e))
+
+	for i, v := range e {
+		s[i] = v.Error()
+	}
+
+	return strings.Join(s, "; ")
+}
+
+func (e ConfigErrors) Len() int      { return len(e) }
+func (e ConfigErrors) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e ConfigErrors) Less(i, j int) bool {
+	if e[i].Server != e[j].Server {
+		return e[i].Server < e[j].Server
+	}
+
+	return e[i].Rule < e[j].Rule
+}
+
+// Handler is a compiled Rule, Index is the position of the rule.
 type Handler struct {
-	Regex  []pcre.Regexp
-	Steps  []Step
-	Target Target
+	Index     int
+	Condition Node
+	Methods   []string
+	Steps     []Step
 }
 
-// Step ...
+// Step is a parsed `do` expression, eg: proxy(http://a, timeout=5s), or the
+// map form of it. Parameters are the text of the arguments, respond(410) has
+// the string "410", actions convert them as they need. Named parameters are
+// kept in Options, converted to the types of the schema.
 type Step struct {
 	Source     string
 	Action     string
 	Parameters []interface{}
+	Options    StepOptions
 }
 
 // NewRouter ...
 func NewRouter(filePath string) *Router {
-	r := &Router{
-		Rules:    []Rule{},
-		Handlers: []Handler{},
+	r, err := LoadRouter(filePath)
+	if err != nil {
+		panic(err.Error())
 	}
 
-	r.loadConfig(filePath)
-	r.parse()
-
 	return r
 }
 
-// Match ...
-func (r *Router) Match(req *http.Request) (bool, Handler) {
-	s := ""
-
-	for _, v := range r.Handlers {
-		for _, regex := range v.Regex {
-			switch v.Target.A {
-			case "url":
-				s = req.Host + req.URL.String()
-			case "header":
-				s = req.Header.Get(v.Target.B)
-			}
+// LoadRouter reads and parses the router config file, the router is only
+// returned when every rule in it is valid.
+func LoadRouter(filePath string) (*Router, error) {
+	config, err := loadConfig(filePath)
+	if err != nil {
+		return nil, err
+	}
 
-			if regex.MatchString(s, 0) {
-				return true, v
-			}
-		}
+	r, errs := buildRouter(config)
+	if len(errs) > 0 {
+		return nil, errs
 	}
 
-	return false, Handler{}
+	return r, nil
 }
 
-// loadConfig ...
-func (r *Router) loadConfig(filePath string) {
-	// Read router config file.
-	bytes, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		panic("router config file do not exist.")
+// buildRouter compiles the config, invalid rules are left out of the router
+// and reported.
+func buildRouter(config Config) (*Router, ConfigErrors) {
+	errs := ConfigErrors{}
+
+	r := &Router{
+		Servers:   map[string]*Server{},
+		wildcards: []*Server{},
 	}
 
-	config := Config{}
+	root, e := newServer("", config.ServerConfig)
+	errs = append(errs, e...)
 
-	err = yaml.Unmarshal(bytes, &config)
-	if err != nil {
-		panic("parse router config file failed.")
-	}
+	r.Server = *root
 
-	r.Rules = config.Rules
-	r.Certificates = config.Certificates
-}
+	r.Upstreams, e = parseUpstreams(config.Upstreams)
+	errs = append(errs, e...)
 
-// parse ...
-func (r *Router) parse() {
-	for _, v := range r.Rules {
-		handler := Handler{
-			Regex: []pcre.Regexp{},
-			Steps: []Step{},
-		}
+	r.TrustedProxies = []*net.IPNet{}
 
-		// Process condition.
-		switch reflect.ValueOf(v.Condition).Kind() {
-		case reflect.String:
-			handler.Regex = append(handler.Regex, pcre.MustCompile(v.Condition.(string), 0))
-		case reflect.Slice:
-			for _, c := range v.Condition.([]interface{}) {
-				handler.Regex = append(handler.Regex, pcre.MustCompile(c.(string), 0))
-			}
-		default:
+	for _, v := range config.TrustedProxies {
+		network, err := parseNetwork(v)
+		if err != nil {
+			errs = append(errs, &ConfigError{"", -1, fmt.Errorf("trusted_proxies: %s", err)})
+			continue
 		}
 
-		// Process target.
-		switch {
-		case reHeaderTest.MatchString(v.Test):
-			t := strings.Split(v.Test, ".")
-			if len(t) != 2 {
-				panic("the matching condition for header is invalid, the correct `test` should be `header.$something`")
-			}
+		r.TrustedProxies = append(r.TrustedProxies, network)
+	}
 
-			handler.Target = Target{"header", t[1]}
+	r.trusted = r.TrustedProxies
 
+	for name, c := range config.Servers {
+		s, e := newServer(strings.ToLower(name), c)
+		errs = append(errs, e...)
+
+		switch {
+		case strings.HasPrefix(s.Name, "*."):
+			r.wildcards = append(r.wildcards, s)
+		case strings.Contains(s.Name, "*"):
+			errs = append(errs, &ConfigError{name, -1, fmt.Errorf("wildcard is only allowed as `*.$domain`")})
 		default:
-			handler.Target = Target{"url", ""}
+			r.Servers[s.Name] = s
 		}
+	}
 
-		// Process action.
-		switch reflect.ValueOf(v.Do).Kind() {
-		case reflect.String:
-			handler.Steps = parseSteps([]interface{}{v.Do})
-		case reflect.Slice:
-			handler.Steps = parseSteps(v.Do.([]interface{}))
-		}
+	// Pages of the server come before the top-level ones.
+	for _, s := range r.Servers {
+		s.ErrorPages = append(s.ErrorPages, r.ErrorPages...)
+		s.trusted = r.TrustedProxies
+	}
 
-		r.Handlers = append(r.Handlers, handler)
+	for _, s := range r.wildcards {
+		s.ErrorPages = append(s.ErrorPages, r.ErrorPages...)
+		s.trusted = r.TrustedProxies
 	}
-}
 
-// parseSteps ...
-func parseSteps(does []interface{}) []Step {
-	steps := []Step{}
+	// The most specific wildcard wins.
+	sort.Slice(r.wildcards, func(i, j int) bool {
+		if len(r.wildcards[i].Name) != len(r.wildcards[j].Name) {
+			return len(r.wildcards[i].Name) > len(r.wildcards[j].Name)
+		}
 
-	for _, v := range does {
-		steps = append(steps, parseDoString(v.(string)))
-	}
+		return r.wildcards[i].Name < r.wildcards[j].Name
+	})
 
-	return steps
+	sort.Sort(errs)
+
+	return r, errs
 }
 
-// parseDoString ...
-func parseDoString(s string) Step {
-	bracketsFound := false
-	action := ""
-	parameters := []interface{}{}
-	t := ""
+// Select returns the server for the host of the request, the host comes from
+// the Host header, or SNI when the header is missing. The top-level server is
+// returned when none matches.
+func (r *Router) Select(req *http.Request) *Server {
+	host := requestHost(req)
+	if host == "" && req.TLS != nil {
+		host = req.TLS.ServerName
+	}
 
-	for i := 0; i < len(s); i++ {
-		if s[i] == space && !isSingleParameter(action) {
-			continue
-		}
+	host = strings.ToLower(host)
 
-		if s[i] != lb && s[i] != rb {
-			if bracketsFound {
-				if s[i] == comma && !isSingleParameter(action) {
-					parameters = append(parameters, t)
-					t = ""
-				} else {
-					t += string(s[i])
-				}
-			} else {
-				action += string(s[i])
-			}
+	if s, ok := r.Servers[host]; ok {
+		return s
+	}
 
-			continue
+	for _, s := range r.wildcards {
+		if strings.HasSuffix(host, s.Name[1:]) {
+			return s
 		}
+	}
 
-		// Process last parameter.
-		if s[i] == rb && len(t) > 0 {
-			parameters = append(parameters, t)
-		}
+	return &r.Server
+}
+
+// Match returns the first handler matching the request, along with the groups
+// captured by its regexes. Groups are keyed by number ("0" is the whole match)
+// and by name.
+func (r *Router) Match(req *http.Request) (bool, Handler, map[string]string) {
+	return r.Select(req).Match(req)
+}
 
-		bracketsFound = true
+// AllCertificates returns certificates of the top-level and every server.
+func (r *Router) AllCertificates() []Certificate {
+	certificates := append([]Certificate{}, r.Certificates...)
+
+	for _, s := range r.Servers {
+		certificates = append(certificates, s.Certificates...)
 	}
 
-	return Step{
-		Source:     s,
-		Action:     action,
-		Parameters: parameters,
+	for _, s := range r.wildcards {
+		certificates = append(certificates, s.Certificates...)
 	}
+
+	return certificates
 }
 
-func isSingleParameter(action string) bool {
-	for _, v := range singleParameterDoes {
-		if v == action {
+// matchMethod reports whether the handler accepts the request method, a handler
+// without methods accepts all of them.
+func (h *Handler) matchMethod(method string) bool {
+	if len(h.Methods) == 0 {
+		return true
+	}
+
+	for _, m := range h.Methods {
+		if m == method {
 			return true
 		}
 	}
 
 	return false
 }
+
+// loadConfig ...
+func loadConfig(filePath string) (Config, error) {
+	// Read router config file.
+	bytes, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return Config{}, fmt.Errorf("router config file do not exist: %s", err)
+	}
+
+	return parseConfig(bytes)
+}
+
+// parseConfig ...
+func parseConfig(bytes []byte) (Config, error) {
+	config := Config{}
+
+	err := yaml.Unmarshal(bytes, &config)
+	if err != nil {
+		return config, fmt.Errorf("parse router config file failed: %s", err)
+	}
+
+	return config, nil
+}
+
+// toStrings accepts a single string or a list of strings from the yaml file.
+func toStrings(v interface{}) ([]string, error) {
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Invalid:
+		return []string{}, nil
+	case reflect.String:
+		return []string{v.(string)}, nil
+	case reflect.Slice:
+		s := []string{}
+
+		for _, item := range v.([]interface{}) {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%v is not a string", item)
+			}
+
+			s = append(s, str)
+		}
+
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("%v should be a string or a list of strings", v)
+}
@@ -0,0 +1,72 @@
+package nginless
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// benchServer builds a server with n rules in the shape of a typical router
+// file: anchored host and path rules, header tests and unanchored regexes.
+func benchServer(b *testing.B, n int) *Server {
+	rules := []Rule{}
+
+	for i := 0; i < n; i++ {
+		var c Clause
+
+		switch i % 4 {
+		case 0:
+			c = Clause{Condition: fmt.Sprintf(`^tenant%d\.testing\.test$`, i), Test: "host"}
+		case 1:
+			c = Clause{Condition: fmt.Sprintf(`^/api/v%d/(?<id>\d+)`, i), Test: "path"}
+		case 2:
+			c = Clause{Condition: fmt.Sprintf(`AppleWebKit\/%d\.\d+`, i), Test: "header.user-agent"}
+		case 3:
+			c = Clause{Condition: fmt.Sprintf(`testing.test:.*/page%d$`, i)}
+		}
+
+		rules = append(rules, Rule{Clause: c, Do: DoConfig{"json({})"}})
+	}
+
+	s, errs := newServer("", ServerConfig{Rules: rules})
+	if len(errs) > 0 {
+		b.Fatal(ConfigErrors(errs))
+	}
+
+	return s
+}
+
+func benchRequests(n int) []*http.Request {
+	return []*http.Request{
+		httptest.NewRequest("GET", fmt.Sprintf("http://tenant%d.testing.test/", n-4), nil),
+		httptest.NewRequest("GET", fmt.Sprintf("http://testing.test/api/v%d/42", n-3), nil),
+		httptest.NewRequest("GET", fmt.Sprintf("http://testing.test/page%d", n-1), nil),
+		httptest.NewRequest("GET", "http://unknown.test/nothing", nil),
+	}
+}
+
+func benchmarkMatch(b *testing.B, n int, indexed bool) {
+	s := benchServer(b, n)
+	requests := benchRequests(n)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		req := requests[i%len(requests)]
+
+		if indexed {
+			s.Match(req)
+		} else {
+			s.scan(req)
+		}
+	}
+}
+
+func BenchmarkMatchIndex10(b *testing.B)  { benchmarkMatch(b, 10, true) }
+func BenchmarkMatchScan10(b *testing.B)   { benchmarkMatch(b, 10, false) }
+func BenchmarkMatchIndex100(b *testing.B) { benchmarkMatch(b, 100, true) }
+func BenchmarkMatchScan100(b *testing.B)  { benchmarkMatch(b, 100, false) }
+func BenchmarkMatchIndex500(b *testing.B) { benchmarkMatch(b, 500, true) }
+func BenchmarkMatchScan500(b *testing.B)  { benchmarkMatch(b, 500, false) }
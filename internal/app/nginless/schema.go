@@ -0,0 +1,592 @@
+package nginless
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Types of options.
+const (
+	optString   = "string"
+	optStrings  = "strings"
+	optBool     = "bool"
+	optInt      = "int"
+	optInts     = "ints"
+	optDuration = "duration"
+)
+
+// Schema describes the arguments of an action. Args are the keys of positional
+// arguments in the map form of a step, eg: `- proxy: {upstreams: [...]}`, the
+// last one takes the rest of the arguments when MaxArgs is unlimited.
+//
+// A Terminal action always finishes the response, steps after it would never
+// run. Other actions change the request or register response hooks for the
+// steps after them, `call` is terminal unless the script calls next().
+type Schema struct {
+	Args     []string
+	MinArgs  int
+	MaxArgs  int
+	Options  map[string]string
+	Terminal bool
+}
+
+// unlimited is MaxArgs of actions taking any number of arguments.
+const unlimited = -1
+
+// proxyOptions are the options of proxy and balancing.
+var proxyOptions = map[string]string{
+	"timeout":          optDuration,
+	"intercept_errors": optBool,
+	"via":              optBool,
+	"preserve_host":    optBool,
+	"host":             optString,
+	"strip_prefix":     optString,
+	"flush_interval":   optDuration,
+	"idle_timeout":     optDuration,
+}
+
+// balancingOptions are the options of proxy, and how balancing picks the
+// upstream.
+var balancingOptions = mergeOptions(proxyOptions, map[string]string{
+	"strategy": optString,
+	"weights":  optInts,
+	"hash_key": optString,
+})
+
+// mergeOptions ...
+func mergeOptions(maps ...map[string]string) map[string]string {
+	merged := map[string]string{}
+
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+
+	return merged
+}
+
+var schemas = map[string]Schema{
+	"proxy":     {Args: []string{"upstreams"}, MinArgs: 1, MaxArgs: unlimited, Options: proxyOptions, Terminal: true},
+	"balancing": {Args: []string{"upstreams"}, MinArgs: 1, MaxArgs: unlimited, Options: balancingOptions, Terminal: true},
+	"call":      {Args: []string{"script"}, MinArgs: 1, MaxArgs: 1},
+	"json":      {Args: []string{"body"}, MinArgs: 1, MaxArgs: 1, Terminal: true},
+	"redirect":  {Args: []string{"code", "target"}, MinArgs: 2, MaxArgs: 2, Terminal: true},
+	"rewrite":   {Args: []string{"pattern", "replacement"}, MinArgs: 2, MaxArgs: 2},
+	"respond": {
+		Args:     []string{"status", "content_type", "body"},
+		MinArgs:  1,
+		MaxArgs:  3,
+		Options:  map[string]string{"file": optString},
+		Terminal: true,
+	},
+	"static": {
+		Args:    []string{"root", "index"},
+		MinArgs: 1,
+		MaxArgs: unlimited,
+		Options: map[string]string{
+			"fallback":      optString,
+			"max_age":       optDuration,
+			"precompressed": optBool,
+		},
+		Terminal: true,
+	},
+
+	"set_header":             {Args: []string{"name", "value"}, MinArgs: 2, MaxArgs: 2},
+	"add_header":             {Args: []string{"name", "value"}, MinArgs: 2, MaxArgs: 2},
+	"remove_header":          {Args: []string{"names"}, MinArgs: 1, MaxArgs: unlimited},
+	"set_response_header":    {Args: []string{"name", "value"}, MinArgs: 2, MaxArgs: 2},
+	"add_response_header":    {Args: []string{"name", "value"}, MinArgs: 2, MaxArgs: 2},
+	"remove_response_header": {Args: []string{"names"}, MinArgs: 1, MaxArgs: unlimited},
+}
+
+// StepOptions are the named arguments of a step, converted to the types given by
+// the schema of the action.
+type StepOptions map[string]interface{}
+
+// String ...
+func (o StepOptions) String(name string, def string) string {
+	if v, ok := o[name].(string); ok {
+		return v
+	}
+
+	return def
+}
+
+// Strings ...
+func (o StepOptions) Strings(name string) []string {
+	if v, ok := o[name].([]string); ok {
+		return v
+	}
+
+	return nil
+}
+
+// Bool ...
+func (o StepOptions) Bool(name string, def bool) bool {
+	if v, ok := o[name].(bool); ok {
+		return v
+	}
+
+	return def
+}
+
+// Int ...
+func (o StepOptions) Int(name string, def int64) int64 {
+	if v, ok := o[name].(int64); ok {
+		return v
+	}
+
+	return def
+}
+
+// Ints ...
+func (o StepOptions) Ints(name string) []int64 {
+	if v, ok := o[name].([]int64); ok {
+		return v
+	}
+
+	return nil
+}
+
+// Duration ...
+func (o StepOptions) Duration(name string, def time.Duration) time.Duration {
+	if v, ok := o[name].(time.Duration); ok {
+		return v
+	}
+
+	return def
+}
+
+// hasArg ...
+func (s Schema) hasArg(name string) bool {
+	for _, v := range s.Args {
+		if v == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseDo accepts the `do` of a rule: a step, or a list of steps. A step is
+// an expression string or a map with the action as its only key:
+//
+//   do:
+//     - proxy:
+//         upstreams: [https://www.google.com]
+//     - json:
+//         body: {success: true}
+func parseDo(v interface{}) ([]Step, error) {
+	items := []interface{}{}
+
+	switch reflect.ValueOf(v).Kind() {
+	case reflect.Invalid:
+	case reflect.Slice:
+		items = v.([]interface{})
+	default:
+		items = append(items, v)
+	}
+
+	steps := []Step{}
+
+	for i, item := range items {
+		var step Step
+		var err error
+
+		if s, ok := item.(yamlScalar); ok {
+			item = s.Value
+		}
+
+		switch t := item.(type) {
+		case string:
+			step, err = parseDoString(t)
+		case map[interface{}]interface{}:
+			step, err = parseDoMap(t)
+		default:
+			err = fmt.Errorf("%v should be a string or a map", item)
+		}
+
+		if err == nil {
+			err = validateStep(&step)
+		}
+
+		if err != nil {
+			if len(items) > 1 {
+				return nil, fmt.Errorf("step %d: %s", i, err)
+			}
+
+			return nil, err
+		}
+
+		steps = append(steps, step)
+	}
+
+	for i, step := range steps {
+		if schemas[step.Action].Terminal && i < len(steps)-1 {
+			return nil, fmt.Errorf("step %d: %s finishes the response, steps after it never run", i, step.Action)
+		}
+	}
+
+	return steps, nil
+}
+
+// parseDoMap parses the map form of a step.
+func parseDoMap(m map[interface{}]interface{}) (Step, error) {
+	if len(m) != 1 {
+		return Step{}, fmt.Errorf("a step should have exactly one action, got %d keys", len(m))
+	}
+
+	step := Step{
+		Parameters: []interface{}{},
+		Options:    StepOptions{},
+	}
+
+	for k, v := range m {
+		step.Action = fmt.Sprint(k)
+		schema, ok := schemas[step.Action]
+		if !ok {
+			return Step{}, fmt.Errorf("unknown action %q", step.Action)
+		}
+
+		switch t := v.(type) {
+		case nil:
+		case map[interface{}]interface{}:
+			args := map[string]interface{}{}
+
+			for name, value := range t {
+				if schema.hasArg(fmt.Sprint(name)) {
+					args[fmt.Sprint(name)] = value
+				} else {
+					step.Options[fmt.Sprint(name)] = yamlText(value)
+				}
+			}
+
+			// Keep the order of the schema.
+			for _, name := range schema.Args {
+				if value, ok := args[name]; ok {
+					step.Parameters = append(step.Parameters, mapArgs(step.Action, value)...)
+				}
+			}
+		default:
+			step.Parameters = mapArgs(step.Action, v)
+		}
+	}
+
+	step.Source = formatStep(step)
+
+	return step, nil
+}
+
+// mapArgs turns the positional arguments in the map form into parameters,
+// which are the text of the scalars as in the expression form. Structured
+// json bodies are encoded.
+func mapArgs(action string, v interface{}) []interface{} {
+	if isSingleParameter(action) {
+		if s, ok := v.(yamlScalar); ok {
+			return []interface{}{s.Text}
+		}
+
+		b, _ := json.Marshal(jsonValue(v))
+
+		return []interface{}{string(b)}
+	}
+
+	if list, ok := v.([]interface{}); ok {
+		args := []interface{}{}
+
+		for _, item := range list {
+			args = append(args, yamlText(item))
+		}
+
+		return args
+	}
+
+	return []interface{}{yamlText(v)}
+}
+
+// yamlScalar is a scalar of the router file, Text is how it is written and
+// Value what yaml reads from it, eg: 007 and 7.
+type yamlScalar struct {
+	Text  string
+	Value interface{}
+}
+
+// yamlText replaces the scalars in a value of DoConfig with their text.
+func yamlText(v interface{}) interface{} {
+	switch t := v.(type) {
+	case yamlScalar:
+		return t.Text
+	case map[interface{}]interface{}:
+		m := map[interface{}]interface{}{}
+
+		for k, item := range t {
+			m[k] = yamlText(item)
+		}
+
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(t))
+
+		for i, item := range t {
+			list[i] = yamlText(item)
+		}
+
+		return list
+	}
+
+	return v
+}
+
+// jsonValue converts maps decoded by yaml, which json can't encode.
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case yamlScalar:
+		return t.Value
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+
+		for k, item := range t {
+			m[fmt.Sprint(k)] = jsonValue(item)
+		}
+
+		return m
+	case []interface{}:
+		list := make([]interface{}, len(t))
+
+		for i, item := range t {
+			list[i] = jsonValue(item)
+		}
+
+		return list
+	}
+
+	return v
+}
+
+// validateStep checks the step against the schema of its action, and converts
+// options to their types.
+func validateStep(step *Step) error {
+	schema, ok := schemas[step.Action]
+	if !ok {
+		return fmt.Errorf("unknown action %q", step.Action)
+	}
+
+	n := len(step.Parameters)
+
+	if n < schema.MinArgs || schema.MaxArgs != unlimited && n > schema.MaxArgs {
+		args := strings.Join(schema.Args, ", ")
+
+		switch {
+		case schema.MaxArgs == unlimited:
+			return fmt.Errorf("%s takes at least %d arguments (%s), got %d", step.Action, schema.MinArgs, args, n)
+		case schema.MinArgs == schema.MaxArgs:
+			return fmt.Errorf("%s takes %d arguments (%s), got %d", step.Action, schema.MinArgs, args, n)
+		}
+
+		return fmt.Errorf("%s takes %d to %d arguments (%s), got %d", step.Action, schema.MinArgs, schema.MaxArgs, args, n)
+	}
+
+	for name, v := range step.Options {
+		kind, ok := schema.Options[name]
+		if !ok {
+			return fmt.Errorf("unknown option %q for %s", name, step.Action)
+		}
+
+		converted, err := convertOption(kind, v)
+		if err != nil {
+			return fmt.Errorf("option %s of %s: %s", name, step.Action, err)
+		}
+
+		step.Options[name] = converted
+	}
+
+	return validateArgs(step)
+}
+
+// validateArgs checks the arguments some actions need to make sense of, the
+// ones rendered from variables are left to the runtime.
+func validateArgs(step *Step) error {
+	switch step.Action {
+	case "redirect":
+		s := paramString(step.Parameters[0])
+
+		if !strings.Contains(s, "{{") {
+			if _, err := redirectCode(s); err != nil {
+				return fmt.Errorf("redirect: %s", err)
+			}
+		}
+
+	case "balancing":
+		strategy := step.Options.String("strategy", strategyRandom)
+		if !strategies[strategy] {
+			return fmt.Errorf("balancing: unknown strategy %q", strategy)
+		}
+
+		weights := step.Options.Ints("weights")
+		if weights != nil && len(weights) != len(step.Parameters) {
+			return fmt.Errorf("balancing: %d weights for %d upstreams", len(weights), len(step.Parameters))
+		}
+
+		for _, w := range weights {
+			if w <= 0 {
+				return fmt.Errorf("balancing: weights should be positive, got %d", w)
+			}
+		}
+
+		if _, err := parseTarget(step.Options.String("hash_key", "ip")); err != nil {
+			return fmt.Errorf("balancing: hash_key: %s", err)
+		}
+
+	case "respond":
+		s := paramString(step.Parameters[0])
+
+		if !strings.Contains(s, "{{") {
+			if _, err := statusCode(s); err != nil {
+				return fmt.Errorf("respond: %s", err)
+			}
+		}
+
+	case "rewrite":
+		s := paramString(step.Parameters[0])
+
+		if !strings.Contains(s, "{{") {
+			if _, err := rewritePattern(s); err != nil {
+				return fmt.Errorf("rewrite: invalid pattern %q: %s", s, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// convertOption ...
+func convertOption(kind string, v interface{}) (interface{}, error) {
+	switch kind {
+	case optString:
+		switch v.(type) {
+		case map[interface{}]interface{}, []interface{}:
+			return nil, fmt.Errorf("expect a string")
+		}
+
+		return fmt.Sprint(v), nil
+
+	case optStrings:
+		if list, ok := v.([]interface{}); ok {
+			s := []string{}
+
+			for _, item := range list {
+				s = append(s, fmt.Sprint(item))
+			}
+
+			return s, nil
+		}
+
+		return []string{fmt.Sprint(v)}, nil
+
+	case optBool:
+		switch t := v.(type) {
+		case bool:
+			return t, nil
+		case string:
+			if b, err := strconv.ParseBool(strings.TrimSpace(t)); err == nil {
+				return b, nil
+			}
+		}
+
+		return nil, fmt.Errorf("expect true or false, got %v", v)
+
+	case optInt:
+		switch t := v.(type) {
+		case int64:
+			return t, nil
+		case float64:
+			if t == float64(int64(t)) {
+				return int64(t), nil
+			}
+		case string:
+			if i, err := strconv.ParseInt(strings.TrimSpace(t), 10, 64); err == nil {
+				return i, nil
+			}
+		}
+
+		return nil, fmt.Errorf("expect an integer, got %v", v)
+
+	case optInts:
+		list, ok := v.([]interface{})
+		if !ok {
+			// eg: weights="3, 1"
+			list = []interface{}{}
+
+			for _, item := range strings.Split(fmt.Sprint(v), ",") {
+				list = append(list, item)
+			}
+		}
+
+		ints := []int64{}
+
+		for _, item := range list {
+			i, err := convertOption(optInt, item)
+			if err != nil {
+				return nil, err
+			}
+
+			ints = append(ints, i.(int64))
+		}
+
+		return ints, nil
+
+	case optDuration:
+		if s, ok := v.(string); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, fmt.Errorf("expect a duration such as 5s, got %q", s)
+			}
+
+			return d, nil
+		}
+
+		return nil, fmt.Errorf("expect a duration such as 5s, got %v", v)
+	}
+
+	return v, nil
+}
+
+// formatStep writes a step in the expression form, for logs.
+func formatStep(step Step) string {
+	args := []string{}
+
+	for _, p := range step.Parameters {
+		args = append(args, formatValue(p))
+	}
+
+	names := []string{}
+	for k := range step.Options {
+		names = append(names, k)
+	}
+
+	sort.Strings(names)
+
+	for _, k := range names {
+		args = append(args, k+"="+formatValue(step.Options[k]))
+	}
+
+	return fmt.Sprintf("%s(%s)", step.Action, strings.Join(args, ", "))
+}
+
+func formatValue(v interface{}) string {
+	if s, ok := v.(string); ok {
+		if s == "" || strings.ContainsAny(s, ",()[]{}\"' ") {
+			return strconv.Quote(s)
+		}
+
+		return s
+	}
+
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,56 @@
+package nginless
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TestParseDoMap checks the map form of a step gives the same step as the
+// expression form.
+func TestParseDoMap(t *testing.T) {
+	cases := []struct {
+		expr string
+		yaml string
+	}{
+		{`set_header(X-Id, 007)`, `set_header: {name: X-Id, value: 007}`},
+		{`set_header(X-Version, 1.10)`, `set_header: {name: X-Version, value: 1.10}`},
+		{`set_header(X-Mode, 010)`, `set_header: {name: X-Mode, value: 010}`},
+		{`set_header(X-Debug, yes)`, `set_header: {name: X-Debug, value: yes}`},
+		{`respond(410)`, `respond: {status: 410}`},
+		{`respond(200, text/plain, ok)`, `respond: {status: 200, content_type: text/plain, body: ok}`},
+		{`call(reverse_proxy)`, `call: reverse_proxy`},
+		{`remove_header(X-A, X-B)`, `remove_header: [X-A, X-B]`},
+		{`json({"a":1,"b":[true,"x"]})`, `json: {body: {a: 1, b: [true, x]}}`},
+		{`proxy(http://a, http://b, timeout=5s, via=true)`, `proxy: {upstreams: [http://a, http://b], timeout: 5s, via: true}`},
+		{`balancing(http://a, http://b, weights="3, 1")`, `balancing: {upstreams: [http://a, http://b], weights: [3, 1]}`},
+	}
+
+	for _, c := range cases {
+		want, err := parseDo(c.expr)
+		if err != nil {
+			t.Errorf("%s: %s", c.expr, err)
+			continue
+		}
+
+		config := struct {
+			Do DoConfig `yaml:"do"`
+		}{}
+
+		if err := yaml.Unmarshal([]byte("do:\n  - "+c.yaml), &config); err != nil {
+			t.Errorf("%s: %s", c.yaml, err)
+			continue
+		}
+
+		got, err := parseDo(config.Do.Value)
+		if err != nil {
+			t.Errorf("%s: %s", c.yaml, err)
+			continue
+		}
+
+		if got[0].Action != want[0].Action || !reflect.DeepEqual(got[0].Parameters, want[0].Parameters) || !reflect.DeepEqual(got[0].Options, want[0].Options) {
+			t.Errorf("%s: got %#v %#v, want %#v %#v", c.yaml, got[0].Parameters, got[0].Options, want[0].Parameters, want[0].Options)
+		}
+	}
+}
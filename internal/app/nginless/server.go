@@ -0,0 +1,142 @@
+package nginless
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ServerConfig is the rules, default steps and certificates of a server in
+// the router config file, the top-level of the file is a server as well.
+type ServerConfig struct {
+	Rules        []Rule        `yaml:"rules"`
+	Default      DoConfig      `yaml:"default"`
+	Certificates []Certificate `yaml:"certificates"`
+	ErrorPages   interface{}   `yaml:"error_pages"`
+}
+
+// Server ...
+type Server struct {
+	Name         string
+	Rules        []Rule
+	Default      []Step
+	Certificates []Certificate
+	ErrorPages   []ErrorPage
+	Handlers     []Handler
+	index        *index
+	trusted      []*net.IPNet
+}
+
+// newServer builds the server from valid rules and reports the invalid ones.
+func newServer(name string, config ServerConfig) (*Server, []*ConfigError) {
+	errs := []*ConfigError{}
+
+	s := &Server{
+		Name:         name,
+		Rules:        config.Rules,
+		Certificates: config.Certificates,
+		Handlers:     []Handler{},
+	}
+
+	steps, err := parseDo(config.Default.Value)
+	if err != nil {
+		errs = append(errs, &ConfigError{name, -1, fmt.Errorf("invalid `default`: %s", err)})
+	}
+
+	s.Default = steps
+
+	pages, err := parseErrorPages(config.ErrorPages)
+	if err != nil {
+		errs = append(errs, &ConfigError{name, -1, fmt.Errorf("invalid `error_pages`: %s", err)})
+	}
+
+	s.ErrorPages = pages
+
+	for i, v := range s.Rules {
+		handler, err := parseRule(v)
+		if err != nil {
+			errs = append(errs, &ConfigError{name, i, err})
+			continue
+		}
+
+		handler.Index = i
+
+		s.Handlers = append(s.Handlers, handler)
+	}
+
+	s.index = newIndex(s.Handlers)
+
+	return s, errs
+}
+
+// Match returns the first handler of the server matching the request, only
+// handlers picked by the index are tried.
+func (s *Server) Match(req *http.Request) (bool, Handler, map[string]string) {
+	sub := newSubject(req, s.trusted)
+
+	for _, i := range s.index.candidates(sub) {
+		if params, ok := s.try(i, sub); ok {
+			return true, s.Handlers[i], params
+		}
+	}
+
+	return false, Handler{}, nil
+}
+
+// scan is Match without the index, it tries every handler in order.
+func (s *Server) scan(req *http.Request) (bool, Handler, map[string]string) {
+	sub := newSubject(req, s.trusted)
+
+	for i := range s.Handlers {
+		if params, ok := s.try(i, sub); ok {
+			return true, s.Handlers[i], params
+		}
+	}
+
+	return false, Handler{}, nil
+}
+
+// try ...
+func (s *Server) try(i int, sub *subject) (map[string]string, bool) {
+	h := &s.Handlers[i]
+
+	if !h.matchMethod(sub.req.Method) {
+		return nil, false
+	}
+
+	return h.Condition.match(sub)
+}
+
+// parseRule ...
+func parseRule(v Rule) (Handler, error) {
+	handler := Handler{
+		Steps: []Step{},
+	}
+
+	// Process condition.
+	condition, err := compileClause(v.Clause)
+	if err != nil {
+		return handler, err
+	}
+
+	handler.Condition = condition
+
+	// Process methods.
+	methods, err := toStrings(v.Method)
+	if err != nil {
+		return handler, fmt.Errorf("invalid `method`: %s", err)
+	}
+
+	for _, m := range methods {
+		handler.Methods = append(handler.Methods, strings.ToUpper(strings.TrimSpace(m)))
+	}
+
+	// Process action.
+	handler.Steps, err = parseDo(v.Do.Value)
+	if err != nil {
+		return handler, fmt.Errorf("invalid `do`: %s", err)
+	}
+
+	return handler, nil
+}
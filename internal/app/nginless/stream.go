@@ -0,0 +1,93 @@
+package nginless
+
+import (
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// flushInterval returns how often the response of the upstream is flushed to
+// the client, -1 is after every write. Event streams and responses without
+// a length are always flushed after every write.
+func flushInterval(res *http.Response, options StepOptions) time.Duration {
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+
+	if mediaType == "text/event-stream" || res.ContentLength == -1 {
+		return -1
+	}
+
+	return options.Duration("flush_interval", 0)
+}
+
+// flushWriter flushes the writes to dst after latency, or right away when
+// latency is negative.
+// refs:
+// https://sourcegraph.com/github.com/golang/go/-/blob/src/net/http/httputil/reverseproxy.go?L586
+type flushWriter struct {
+	dst     *responseWriter
+	latency time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
+}
+
+// newFlushWriter ...
+func newFlushWriter(dst *responseWriter, latency time.Duration) *flushWriter {
+	return &flushWriter{dst: dst, latency: latency}
+}
+
+// Write ...
+func (w *flushWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err := w.dst.Write(p)
+
+	if w.latency < 0 {
+		w.dst.Flush()
+		return n, err
+	}
+
+	if w.pending {
+		return n, err
+	}
+
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.latency, w.flush)
+	} else {
+		w.timer.Reset(w.latency)
+	}
+
+	w.pending = true
+
+	return n, err
+}
+
+// flush ...
+func (w *flushWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Stopped already.
+	if !w.pending {
+		return
+	}
+
+	w.dst.Flush()
+	w.pending = false
+}
+
+// stop cancels the pending flush, the handler flushes what is left when it
+// returns.
+func (w *flushWriter) stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = false
+
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+}
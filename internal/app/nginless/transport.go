@@ -0,0 +1,213 @@
+package nginless
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamConfig is the connection pool of an upstream in the router config
+// file, unset fields take the value of `default`, then defaultUpstream.
+//
+// upstreams:
+//   default:
+//     max_idle_conns: 64
+//   http://backend:8080:
+//     max_conns: 256
+//     idle_timeout: 90s
+//     keep_alive: 30s
+//     dial_timeout: 5s
+//     response_header_timeout: 10s
+type UpstreamConfig struct {
+	MaxIdleConns          int           `yaml:"max_idle_conns"`
+	MaxConns              int           `yaml:"max_conns"`
+	IdleTimeout           time.Duration `yaml:"idle_timeout"`
+	KeepAlive             time.Duration `yaml:"keep_alive"`
+	DialTimeout           time.Duration `yaml:"dial_timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+}
+
+// defaultUpstream follows http.DefaultTransport, with more idle connections
+// kept since every transport talks to a single upstream.
+var defaultUpstream = UpstreamConfig{
+	MaxIdleConns: 64,
+	IdleTimeout:  90 * time.Second,
+	KeepAlive:    30 * time.Second,
+	DialTimeout:  30 * time.Second,
+}
+
+// merge fills the unset fields of c from def.
+func (c UpstreamConfig) merge(def UpstreamConfig) UpstreamConfig {
+	if c.MaxIdleConns == 0 {
+		c.MaxIdleConns = def.MaxIdleConns
+	}
+
+	if c.MaxConns == 0 {
+		c.MaxConns = def.MaxConns
+	}
+
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = def.IdleTimeout
+	}
+
+	if c.KeepAlive == 0 {
+		c.KeepAlive = def.KeepAlive
+	}
+
+	if c.DialTimeout == 0 {
+		c.DialTimeout = def.DialTimeout
+	}
+
+	if c.ResponseHeaderTimeout == 0 {
+		c.ResponseHeaderTimeout = def.ResponseHeaderTimeout
+	}
+
+	return c
+}
+
+// parseUpstreams validates the `upstreams` of the router and keys them by
+// upstreamKey, `default` keeps its name.
+func parseUpstreams(config map[string]UpstreamConfig) (map[string]UpstreamConfig, []*ConfigError) {
+	errs := []*ConfigError{}
+
+	def := config["default"].merge(defaultUpstream)
+	upstreams := map[string]UpstreamConfig{"default": def}
+
+	for name, c := range config {
+		if name == "default" {
+			continue
+		}
+
+		u, err := url.Parse(name)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, &ConfigError{"", -1, fmt.Errorf("upstreams: invalid upstream %q, expect scheme://host[:port]", name)})
+			continue
+		}
+
+		upstreams[upstreamKey(u)] = c.merge(def)
+	}
+
+	return upstreams, errs
+}
+
+// upstreamKey ...
+func upstreamKey(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// upstreamTransports is shared by proxy, balancing and fetch of scripts.
+var upstreamTransports = newTransports()
+
+// maxUnlistedTransports bounds the transports of upstreams not listed in the
+// config, such upstreams can be rendered from the request.
+const maxUnlistedTransports = 256
+
+// transports keeps a transport per upstream, so connections to it are reused.
+// Upstreams listed in the config keep theirs as long as they are listed, the
+// others share a bounded set of the ones used last. A transport is replaced
+// when the config of its upstream changes.
+type transports struct {
+	mu       sync.Mutex
+	upstream map[string]UpstreamConfig
+	pool     map[string]*pooledTransport
+	unlisted *lru
+}
+
+type pooledTransport struct {
+	config    UpstreamConfig
+	transport *http.Transport
+}
+
+// newTransports ...
+func newTransports() *transports {
+	return &transports{
+		upstream: map[string]UpstreamConfig{},
+		pool:     map[string]*pooledTransport{},
+		unlisted: newLRU(maxUnlistedTransports, func(v interface{}) {
+			v.(*pooledTransport).transport.CloseIdleConnections()
+		}),
+	}
+}
+
+// configure sets the configs of upstreams, transports are replaced on their
+// next use.
+func (t *transports) configure(upstreams map[string]UpstreamConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.upstream = upstreams
+
+	// Upstreams no longer listed start over with the unlisted ones.
+	for key, p := range t.pool {
+		if _, ok := upstreams[key]; !ok {
+			p.transport.CloseIdleConnections()
+			delete(t.pool, key)
+		}
+	}
+}
+
+// get returns the transport of the upstream of u.
+func (t *transports) get(u *url.URL) *http.Transport {
+	key := upstreamKey(u)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	config, listed := t.upstream[key]
+	if !listed {
+		config = t.upstream["default"].merge(defaultUpstream)
+	}
+
+	var p *pooledTransport
+	var ok bool
+
+	if listed {
+		p, ok = t.pool[key]
+	} else if v, found := t.unlisted.load(key); found {
+		p, ok = v.(*pooledTransport), true
+	}
+
+	if ok && p.config == config {
+		return p.transport
+	}
+
+	// Requests in flight keep the old one, its idle connections are dropped.
+	if ok {
+		p.transport.CloseIdleConnections()
+	}
+
+	p = &pooledTransport{config, newTransport(config)}
+
+	if listed {
+		t.pool[key] = p
+	} else {
+		t.unlisted.store(key, p)
+	}
+
+	return p.transport
+}
+
+// newTransport ...
+func newTransport(c UpstreamConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   c.DialTimeout,
+		KeepAlive: c.KeepAlive,
+	}
+
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConns,
+		MaxConnsPerHost:       c.MaxConns,
+		IdleConnTimeout:       c.IdleTimeout,
+		ResponseHeaderTimeout: c.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
@@ -0,0 +1,150 @@
+package nginless
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// upgradeType returns the protocol the request or response upgrades to, eg:
+// websocket, or an empty string when it doesn't.
+func upgradeType(h http.Header) string {
+	for _, v := range h.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+
+	return ""
+}
+
+// writeUpgrade switches the client to the protocol the upstream accepted and
+// tunnels the connection to it, until either side closes it or it is idle for
+// idle_timeout.
+func (n *Nginless) writeUpgrade(d *D, res *http.Response, options StepOptions) *D {
+	upstream := res.Request.URL.Host
+	protocol := upgradeType(res.Header)
+
+	if !strings.EqualFold(protocol, upgradeType(d.req.Header)) {
+		res.Body.Close()
+		n.logger.Error(".doProxy upstream switched to another protocol", zap.String("upstream", upstream), zap.String("protocol", protocol))
+		return d.returnError(http.StatusBadGateway)
+	}
+
+	backend, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		res.Body.Close()
+		n.logger.Error(".doProxy upgraded body is not writable", zap.String("upstream", upstream))
+		return d.returnError(http.StatusBadGateway)
+	}
+
+	defer backend.Close()
+
+	conn, brw, err := d.res.Hijack()
+	if err != nil {
+		n.logger.Error(".doProxy hijack failed", zap.String("upstream", upstream), zap.Error(err))
+		return d.returnError(http.StatusInternalServerError)
+	}
+
+	defer conn.Close()
+
+	// Copy response headers, Connection and Upgrade are hop-by-hop but make
+	// the switch.
+	removeHopHeaders(res.Header)
+
+	for k, headers := range res.Header {
+		if strings.ToLower(k) == "x-nginless-version" {
+			continue
+		}
+
+		d.res.Header()[k] = headers
+	}
+
+	d.res.Header().Set("Connection", "Upgrade")
+	d.res.Header().Set("Upgrade", protocol)
+	d.res.commit(res.StatusCode)
+
+	res.Header = d.res.Header()
+	res.Body = nil
+
+	if err := res.Write(brw); err == nil {
+		err = brw.Flush()
+	}
+
+	if err != nil {
+		n.logger.Error(".doProxy write upgrade response failed", zap.String("upstream", upstream), zap.Error(err))
+		return d.done()
+	}
+
+	start := time.Now()
+
+	// Either side closing, or being idle too long, ends the tunnel.
+	closeAll := func() {
+		conn.Close()
+		backend.Close()
+	}
+
+	touch := func() {}
+
+	if timeout := options.Duration("idle_timeout", 0); timeout > 0 {
+		idle := time.AfterFunc(timeout, closeAll)
+		defer idle.Stop()
+
+		touch = func() { idle.Reset(timeout) }
+	}
+
+	var sent, received int64
+
+	errc := make(chan error, 2)
+
+	// The reader of brw has what the client sent after the request.
+	go func() {
+		_, err := io.Copy(backend, &tunnelReader{brw, touch, &sent})
+		errc <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(conn, &tunnelReader{backend, touch, &received})
+		errc <- err
+	}()
+
+	<-errc
+	closeAll()
+	<-errc
+
+	n.logger.Info(
+		".doProxy upgrade closed",
+		zap.String("upstream", upstream),
+		zap.String("protocol", protocol),
+		zap.Int64("sent", atomic.LoadInt64(&sent)),
+		zap.Int64("received", atomic.LoadInt64(&received)),
+		zap.Duration("elapsed", time.Since(start)),
+	)
+
+	return d.done()
+}
+
+// tunnelReader counts the bytes read and marks the tunnel active.
+type tunnelReader struct {
+	r     io.Reader
+	touch func()
+	n     *int64
+}
+
+// Read ...
+func (t *tunnelReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+
+	if n > 0 {
+		atomic.AddInt64(t.n, int64(n))
+		t.touch()
+	}
+
+	return n, err
+}